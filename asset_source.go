@@ -0,0 +1,79 @@
+package libcore
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/mobile/asset"
+)
+
+// AssetSource opens the bundled assets extracted by InitializeV2Ray, like geosite.dat.xz and its version file.
+type AssetSource interface {
+	Open(name string) (io.ReadSeekCloser, error)
+}
+
+var assetSource AssetSource = apkAssetSource{}
+
+// SetAssetSource replaces the assets of the apk, it should be called before InitializeV2Ray.
+func SetAssetSource(source AssetSource) {
+	if source == nil {
+		source = apkAssetSource{}
+	}
+	assetSource = source
+}
+
+type apkAssetSource struct{}
+
+func (apkAssetSource) Open(name string) (io.ReadSeekCloser, error) {
+	return asset.Open(name)
+}
+
+type directoryAssetSource struct {
+	dir string
+}
+
+// NewDirectoryAssetSource reads assets from a directory, for desktop builds.
+func NewDirectoryAssetSource(dir string) AssetSource {
+	return directoryAssetSource{dir}
+}
+
+func (s directoryAssetSource) Open(name string) (io.ReadSeekCloser, error) {
+	return os.Open(filepath.Join(s.dir, filepath.FromSlash(name)))
+}
+
+type fsAssetSource struct {
+	fsys fs.FS
+}
+
+// NewFSAssetSource reads assets from a file system like an embed.FS.
+func NewFSAssetSource(fsys fs.FS) AssetSource {
+	return fsAssetSource{fsys}
+}
+
+type nopSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
+
+func (s fsAssetSource) Open(name string) (io.ReadSeekCloser, error) {
+	file, err := s.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if seeker, ok := file.(io.ReadSeekCloser); ok {
+		return seeker, nil
+	}
+	// files of a generic fs.FS are not required to seek
+	content, err := io.ReadAll(file)
+	_ = file.Close()
+	if err != nil {
+		return nil, err
+	}
+	return nopSeekCloser{bytes.NewReader(content)}, nil
+}
@@ -1,15 +1,18 @@
 package libcore
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/sirupsen/logrus"
+	"github.com/ulikunitz/xz"
 	"github.com/v2fly/v2ray-core/v5/common/platform/filesystem"
-	"golang.org/x/mobile/asset"
 	"libcore/comm"
 )
 
@@ -21,6 +24,8 @@ const (
 	geositeVersion     = "geosite.version.txt"
 	coreVersion        = "core.version.txt"
 	mozillaIncludedPem = "mozilla_included.pem"
+
+	assetChecksumSuffix = ".sha256sum"
 )
 
 var (
@@ -31,10 +36,23 @@ var (
 
 var (
 	useOfficialAssets bool
-	extracted         map[string]bool
-	assetsAccess      *sync.Mutex
+	// extracted holds the asset names extracted or opened from the asset source since InitializeV2Ray
+	extracted    sync.Map
+	assetsAccess *sync.Mutex
+	// verifiedAssets holds the paths checked by verifyAsset
+	verifiedAssets sync.Map
+	// assetLocks holds a *sync.Mutex for each asset name, held while it is verified or extracted
+	assetLocks sync.Map
 )
 
+// lockAsset locks an asset name and returns the function to unlock it.
+func lockAsset(name string) func() {
+	value, _ := assetLocks.LoadOrStore(name, new(sync.Mutex))
+	mutex := value.(*sync.Mutex)
+	mutex.Lock()
+	return mutex.Unlock
+}
+
 type Func interface {
 	Invoke() error
 }
@@ -46,20 +64,28 @@ type BoolFunc interface {
 func InitializeV2Ray(internalAssets string, externalAssets string, prefix string, useOfficial BoolFunc, useSystemCerts BoolFunc, skipExtract bool) error {
 	assetsAccess = new(sync.Mutex)
 	assetsAccess.Lock()
-	extracted = make(map[string]bool)
+	extracted.Range(func(key, _ interface{}) bool {
+		extracted.Delete(key)
+		return true
+	})
 
 	assetsPrefix = prefix
 	internalAssetsPath = internalAssets
 	externalAssetsPath = externalAssets
+	selectIndexedGeoLoader()
 
 	filesystem.NewFileSeeker = func(path string) (io.ReadSeekCloser, error) {
 		_, fileName := filepath.Split(path)
 
-		if !extracted[fileName] {
+		if _, ok := extracted.Load(fileName); !ok {
 			assetsAccess.Lock()
 			assetsAccess.Unlock()
 		}
 
+		// concurrent opens of a corrupted asset extract it only once
+		unlock := lockAsset(fileName)
+		defer unlock()
+
 		paths := []string{
 			internalAssetsPath + fileName,
 			externalAssetsPath + fileName,
@@ -70,17 +96,28 @@ func InitializeV2Ray(internalAssets string, externalAssets string, prefix string
 		for _, path = range paths {
 			_, err = os.Stat(path)
 			if err == nil {
-				return os.Open(path)
+				err = verifyAsset(path)
+				if err == nil {
+					return os.Open(path)
+				}
+				if assetVersionName(fileName) == "" {
+					return nil, err
+				}
+				logrus.Warn(newError("asset ", fileName, " is corrupted, extracting again").Base(err))
+				if err = extractAssetNameLocked(fileName, true); err != nil {
+					return nil, err
+				}
+				return os.Open(assetDir(fileName) + fileName)
 			}
 		}
 
-		file, err := asset.Open(assetsPrefix + fileName)
+		file, err := assetSource.Open(assetsPrefix + fileName)
 		if err == nil {
-			extracted[fileName] = true
+			extracted.Store(fileName, true)
 			return file, nil
 		}
 
-		err = extractAssetName(fileName, false)
+		err = extractAssetNameLocked(fileName, false)
 		if err != nil {
 			return nil, err
 		}
@@ -110,9 +147,9 @@ func InitializeV2Ray(internalAssets string, externalAssets string, prefix string
 	extract := func(name string) {
 		err := extractAssetName(name, false)
 		if err != nil {
-			logrus.Warnf("Extract %s failed: %v", geoipDat, err)
+			logrus.Warnf("Extract %s failed: %v", name, err)
 		} else {
-			extracted[name] = true
+			extracted.Store(name, true)
 		}
 	}
 
@@ -136,28 +173,46 @@ func InitializeV2Ray(internalAssets string, externalAssets string, prefix string
 	return nil
 }
 
-func extractAssetName(name string, force bool) error {
-	var dir string
+// assetDir returns the directory a bundled asset is extracted to.
+func assetDir(name string) string {
 	if name == browserForwarder {
-		dir = internalAssetsPath
-	} else {
-		dir = externalAssetsPath
+		return internalAssetsPath
 	}
-	var version string
+	return externalAssetsPath
+}
+
+// assetVersionName returns the version file of a bundled asset, or an empty string for other files.
+func assetVersionName(name string) string {
 	switch name {
 	case geoipDat:
-		version = geoipVersion
+		return geoipVersion
 	case geositeDat:
-		version = geositeVersion
+		return geositeVersion
 	case browserForwarder:
-		version = coreVersion
+		return coreVersion
+	}
+	return ""
+}
+
+func extractAssetName(name string, force bool) error {
+	unlock := lockAsset(name)
+	defer unlock()
+	return extractAssetNameLocked(name, force)
+}
+
+// extractAssetNameLocked is extractAssetName with the asset locked by the caller.
+func extractAssetNameLocked(name string, force bool) error {
+	dir := assetDir(name)
+	version := assetVersionName(name)
+	if version == "" {
+		return newError("not a bundled asset: ", name)
 	}
 
 	var localVersion string
 	var assetVersion string
 
 	loadAssetVersion := func() error {
-		av, err := asset.Open(assetsPrefix + version)
+		av, err := assetSource.Open(assetsPrefix + version)
 		if err != nil {
 			return newError("open version in assets").Base(err)
 		}
@@ -181,7 +236,7 @@ func extractAssetName(name string, force bool) error {
 		b, err := os.ReadFile(dir + version)
 		if err != nil {
 			doExtract = true
-			_ = os.RemoveAll(version)
+			_ = os.Remove(dir + version)
 		} else {
 			localVersion = string(b)
 			err = loadAssetVersion()
@@ -211,27 +266,22 @@ func extractAssetName(name string, force bool) error {
 		return nil
 	}
 
-	err := extractAsset(assetsPrefix+name+".xz", dir+name)
-	if err == nil {
-		err = unxz(dir + name)
-	}
+	err := extractAsset(name, dir, version, assetVersion)
 	if err != nil {
-		return err
+		return newError("failed to extract ", name).Base(err)
 	}
-
-	o, err := os.Create(dir + version)
-	if err != nil {
-		return err
+	if name != browserForwarder {
+		if err = writeGeoIndex(dir + name); err != nil {
+			logrus.Warn(newError("failed to index ", name).Base(err))
+		}
 	}
-	_, err = io.WriteString(o, assetVersion)
-	comm.CloseIgnore(o)
-	return err
+	return nil
 }
 
 func extractRootCACertsPem() error {
 	path := internalAssetsPath + mozillaIncludedPem
 	sumPath := path + ".sha256sum"
-	sumInternal, err := asset.Open(mozillaIncludedPem + ".sha256sum")
+	sumInternal, err := assetSource.Open(mozillaIncludedPem + ".sha256sum")
 	if err != nil {
 		return newError("open pem version in assets").Base(err)
 	}
@@ -249,37 +299,127 @@ func extractRootCACertsPem() error {
 			}
 		}
 	}
-	pemFile, err := os.Create(path)
-	if err != nil {
-		return newError("create pem file").Base(err)
-	}
-	defer pemFile.Close()
-	pem, err := asset.Open(mozillaIncludedPem)
+	// committed by renaming the pem and then the sum like extractAsset, an interrupted write leaves a sum mismatch
+	files := []string{path, sumPath}
+	defer func() {
+		for _, file := range files {
+			_ = os.Remove(file + ".tmp")
+		}
+	}()
+	pem, err := assetSource.Open(mozillaIncludedPem)
 	if err != nil {
 		return newError("open pem in assets").Base(err)
 	}
 	defer pem.Close()
+	pemFile, err := os.Create(path + ".tmp")
+	if err != nil {
+		return newError("create pem file").Base(err)
+	}
 	_, err = io.Copy(pemFile, pem)
+	if err == nil {
+		err = pemFile.Sync()
+	}
+	if closeErr := pemFile.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		return newError("write pem file")
+		return newError("write pem file").Base(err)
+	}
+	if err = os.WriteFile(sumPath+".tmp", sumBytes, 0o644); err != nil {
+		return err
 	}
-	return os.WriteFile(sumPath, sumBytes, 0o644)
+	for _, file := range files {
+		if err = os.Rename(file+".tmp", file); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func extractAsset(assetPath string, path string) error {
-	i, err := asset.Open(assetPath)
+// extractAsset decompresses name.xz from the assets to dir with its sha256 sum and version.
+// All files are written to .tmp files first and committed by renaming the data, the sum and then the version,
+// so an interrupted extraction leaves either a sum mismatch found by verifyAsset or an older version to be extracted again.
+func extractAsset(name string, dir string, version string, assetVersion string) error {
+	path := dir + name
+	files := []string{path, path + assetChecksumSuffix, dir + version}
+	defer func() {
+		for _, file := range files {
+			_ = os.Remove(file + ".tmp")
+		}
+	}()
+
+	i, err := assetSource.Open(assetsPrefix + name + ".xz")
 	if err != nil {
 		return err
 	}
 	defer comm.CloseIgnore(i)
-	o, err := os.Create(path)
+	// the reader verifies the checks of the xz stream, a truncated or corrupted stream fails before EOF
+	r, err := xz.NewReader(i)
 	if err != nil {
 		return err
 	}
-	defer comm.CloseIgnore(o)
-	_, err = io.Copy(o, i)
+	o, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(o, hash), r)
 	if err == nil {
-		logrus.Debugf("Extract >> %s", path)
+		err = o.Sync()
+	}
+	if closeErr := o.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if err = os.WriteFile(path+assetChecksumSuffix+".tmp", []byte(sum+"  "+name+"\n"), 0o644); err != nil {
+		return err
+	}
+	if err = os.WriteFile(dir+version+".tmp", []byte(assetVersion), 0o644); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = os.Rename(file+".tmp", file); err != nil {
+			return err
+		}
 	}
-	return err
+	verifiedAssets.Store(path, true)
+	logrus.Debugf("Extract >> %s", path)
+	return nil
+}
+
+// verifyAsset checks a file against the sha256 sum recorded next to it once per process,
+// files without a recorded sum like the ones downloaded by the user are not checked.
+func verifyAsset(path string) error {
+	if _, verified := verifiedAssets.Load(path); verified {
+		return nil
+	}
+	content, err := os.ReadFile(path + assetChecksumSuffix)
+	if os.IsNotExist(err) {
+		verifiedAssets.Store(path, true)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return newError("empty sha256 sum of ", path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer comm.CloseIgnore(file)
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(sum, fields[0]) {
+		return newError("sha256 mismatch, expected ", fields[0], " but got ", sum)
+	}
+	verifiedAssets.Store(path, true)
+	return nil
 }
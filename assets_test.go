@@ -0,0 +1,239 @@
+package libcore
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/ulikunitz/xz"
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+	"github.com/v2fly/v2ray-core/v5/common/platform/filesystem"
+)
+
+type testBoolFunc bool
+
+func (f testBoolFunc) Invoke() bool {
+	return bool(f)
+}
+
+// testGeoSite is a geosite file with a single category, so that it can be indexed after extraction.
+func testGeoSite(t *testing.T, code string) []byte {
+	content, err := proto.Marshal(&routercommon.GeoSiteList{Entry: []*routercommon.GeoSite{{CountryCode: code}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func compressXZ(t *testing.T, content []byte) []byte {
+	buffer := new(bytes.Buffer)
+	writer, err := xz.NewWriter(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = writer.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// setTestGeoSiteAsset replaces the bundled geosite.dat and its version.
+func setTestGeoSiteAsset(source fstest.MapFS, xzContent []byte, version string) {
+	source[geositeDat+".xz"] = &fstest.MapFile{Data: xzContent}
+	source[geositeVersion] = &fstest.MapFile{Data: []byte(version)}
+}
+
+func readTestAsset(t *testing.T, name string) string {
+	file, err := filesystem.NewFileSeeker(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestExtractAssets(t *testing.T) {
+	dir := t.TempDir() + "/"
+	path := dir + geositeDat
+	source := fstest.MapFS{}
+	SetAssetSource(NewFSAssetSource(source))
+	t.Cleanup(func() { SetAssetSource(nil) })
+	verifiedAssets.Delete(path)
+
+	// first extraction
+	setTestGeoSiteAsset(source, compressXZ(t, testGeoSite(t, "v1")), "1")
+	if err := InitializeV2Ray(dir, dir, "", testBoolFunc(true), testBoolFunc(false), false); err != nil {
+		t.Fatal(err)
+	}
+	if content := readTestAsset(t, geositeDat); content != string(testGeoSite(t, "v1")) {
+		t.Fatalf("first extraction: got %q", content)
+	}
+	if _, err := os.Stat(path + assetChecksumSuffix); err != nil {
+		t.Fatal("sum not written: ", err)
+	}
+
+	// a newer version is extracted, an older one is not
+	setTestGeoSiteAsset(source, compressXZ(t, testGeoSite(t, "v2")), "2")
+	if err := extractAssetName(geositeDat, false); err != nil {
+		t.Fatal(err)
+	}
+	if content := readTestAsset(t, geositeDat); content != string(testGeoSite(t, "v2")) {
+		t.Fatalf("version upgrade: got %q", content)
+	}
+	setTestGeoSiteAsset(source, compressXZ(t, testGeoSite(t, "v0")), "0")
+	if err := extractAssetName(geositeDat, false); err != nil {
+		t.Fatal(err)
+	}
+	if content := readTestAsset(t, geositeDat); content != string(testGeoSite(t, "v2")) {
+		t.Fatalf("version downgrade: got %q", content)
+	}
+
+	// a truncated stream fails without touching the extracted file
+	xzContent := compressXZ(t, bytes.Repeat(testGeoSite(t, "v3"), 1000))
+	setTestGeoSiteAsset(source, xzContent[:len(xzContent)/2], "3")
+	if err := extractAssetName(geositeDat, false); err == nil {
+		t.Fatal("truncated xz extracted")
+	}
+	if content, _ := os.ReadFile(path); string(content) != string(testGeoSite(t, "v2")) {
+		t.Fatalf("truncated xz: got %q", content)
+	}
+	if version, _ := os.ReadFile(dir + geositeVersion); string(version) != "2" {
+		t.Fatalf("truncated xz: got version %q", version)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".tmp") {
+			t.Errorf("%s is left", entry.Name())
+		}
+	}
+}
+
+// corruptTestAsset flips the first byte of a file.
+func corruptTestAsset(t *testing.T, path string) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[0] ^= 0xff
+	if err = os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	verifiedAssets.Delete(path)
+}
+
+func TestAssetSelfHeal(t *testing.T) {
+	dir := t.TempDir() + "/"
+	path := dir + geositeDat
+	source := fstest.MapFS{}
+	SetAssetSource(NewFSAssetSource(source))
+	t.Cleanup(func() { SetAssetSource(nil) })
+	setTestGeoSiteAsset(source, compressXZ(t, testGeoSite(t, "v1")), "1")
+	verifiedAssets.Delete(path)
+	if err := InitializeV2Ray(dir, dir, "", testBoolFunc(true), testBoolFunc(false), false); err != nil {
+		t.Fatal(err)
+	}
+	if content := readTestAsset(t, geositeDat); content != string(testGeoSite(t, "v1")) {
+		t.Fatalf("got %q", content)
+	}
+
+	corruptTestAsset(t, path)
+	if content := readTestAsset(t, geositeDat); content != string(testGeoSite(t, "v1")) {
+		t.Fatalf("self-heal: got %q", content)
+	}
+
+	// concurrent opens extract the corrupted file once
+	corruptTestAsset(t, path)
+	var wg sync.WaitGroup
+	contents := make([]string, 8)
+	for i := range contents {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			file, err := filesystem.NewFileSeeker(geositeDat)
+			if err != nil {
+				contents[i] = err.Error()
+				return
+			}
+			content, _ := io.ReadAll(file)
+			_ = file.Close()
+			contents[i] = string(content)
+		}(i)
+	}
+	wg.Wait()
+	for i, content := range contents {
+		if content != string(testGeoSite(t, "v1")) {
+			t.Errorf("concurrent open %d: got %q", i, content)
+		}
+	}
+
+	// a truncated file is extracted again
+	if err := os.Truncate(path, 1); err != nil {
+		t.Fatal(err)
+	}
+	verifiedAssets.Delete(path)
+	if content := readTestAsset(t, geositeDat); content != string(testGeoSite(t, "v1")) {
+		t.Fatalf("truncated file: got %q", content)
+	}
+
+	// a file replaced on purpose has its sum removed and is left as is
+	if err := os.WriteFile(path, []byte("replaced by the user"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path + assetChecksumSuffix); err != nil {
+		t.Fatal(err)
+	}
+	verifiedAssets.Delete(path)
+	if content := readTestAsset(t, geositeDat); content != "replaced by the user" {
+		t.Fatalf("replaced file: got %q", content)
+	}
+}
+
+func TestExtractRootCACertsPem(t *testing.T) {
+	dir := t.TempDir() + "/"
+	source := fstest.MapFS{
+		mozillaIncludedPem:                &fstest.MapFile{Data: []byte("pem v1")},
+		mozillaIncludedPem + ".sha256sum": &fstest.MapFile{Data: []byte("sum v1")},
+	}
+	SetAssetSource(NewFSAssetSource(source))
+	t.Cleanup(func() { SetAssetSource(nil) })
+	internalAssetsPath = dir
+
+	// a pem left truncated by an interrupted write without its new sum is written again
+	if err := os.WriteFile(dir+mozillaIncludedPem, []byte("pem"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir+mozillaIncludedPem+".sha256sum", []byte("sum v0"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := extractRootCACertsPem(); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(dir + mozillaIncludedPem); string(content) != "pem v1" {
+		t.Fatalf("got %q", content)
+	}
+	if content, _ := os.ReadFile(dir + mozillaIncludedPem + ".sha256sum"); string(content) != "sum v1" {
+		t.Fatalf("got sum %q", content)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("got %d files", len(entries))
+	}
+}
@@ -6,26 +6,18 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"net"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/quic-go/quic-go"
-	"github.com/wzshiming/socks5"
 )
 
-func ProbeCertTLS(ctx context.Context, address, sni string, useSOCKS5 bool, socksPort int) ([]*x509.Certificate, error) {
-	var conn net.Conn
-	var err error
-	if useSOCKS5 {
-		dialer, _ := socks5.NewDialer("socks5h://127.0.0.1:" + strconv.Itoa(socksPort))
-		conn, err = dialer.DialContext(ctx, "tcp", address)
-	} else {
-		dialer := new(net.Dialer)
-		conn, err = dialer.DialContext(ctx, "tcp", address)
-	}
+func (d *outboundDialer) probeTLS(ctx context.Context, address, sni string) (*tls.ConnectionState, error) {
+	conn, err := d.dialContext(ctx, "tcp", address)
 	if err != nil {
 		return nil, err
 	}
@@ -40,45 +32,16 @@ func ProbeCertTLS(ctx context.Context, address, sni string, useSOCKS5 bool, sock
 		return nil, err
 	}
 	defer tlsConn.Close()
-	return tlsConn.ConnectionState().PeerCertificates, nil
-}
-
-type udpAddr struct {
-	address string
-}
-
-func (a *udpAddr) Network() string {
-	return "udp"
-}
-
-func (a *udpAddr) String() string {
-	return a.address
+	state := tlsConn.ConnectionState()
+	return &state, nil
 }
 
-func ProbeCertQUIC(ctx context.Context, address, sni string, useSOCKS5 bool, socksPort int) ([]*x509.Certificate, error) {
-	var packetConn net.PacketConn
-	var addr net.Addr
-	var err error
-	if useSOCKS5 {
-		dialer, _ := socks5.NewDialer("socks5h://127.0.0.1:" + strconv.Itoa(socksPort))
-		conn, err := dialer.DialContext(ctx, "udp", address)
-		if err != nil {
-			return nil, err
-		}
-		defer conn.Close()
-		packetConn = conn.(*socks5.UDPConn)
-		addr = &udpAddr{address: address}
-	} else {
-		packetConn, err = net.ListenUDP("udp", nil)
-		if err != nil {
-			return nil, err
-		}
-		defer packetConn.Close()
-		addr, err = net.ResolveUDPAddr("udp", address)
-		if err != nil {
-			return nil, err
-		}
+func (d *outboundDialer) probeQUIC(ctx context.Context, address, sni string) (*tls.ConnectionState, error) {
+	packetConn, addr, err := d.listenPacket(ctx, address)
+	if err != nil {
+		return nil, err
 	}
+	defer packetConn.Close()
 	quicConn, err := quic.Dial(ctx, packetConn, addr, &tls.Config{
 		InsecureSkipVerify: true,
 		NextProtos:         []string{"h3"},
@@ -88,29 +51,77 @@ func ProbeCertQUIC(ctx context.Context, address, sni string, useSOCKS5 bool, soc
 		return nil, err
 	}
 	defer quicConn.CloseWithError(0x00, "")
-	return quicConn.ConnectionState().TLS.PeerCertificates, nil
+	state := quicConn.ConnectionState().TLS
+	return &state, nil
 }
 
-func ProbeCert(address, sni, protocol string, useSOCKS5 bool, socksPort int32) (cert string, err error) {
+func ProbeCertTLS(ctx context.Context, address, sni string, useSOCKS5 bool, socksPort int) ([]*x509.Certificate, error) {
+	state, err := newOutboundDialer(useSOCKS5, socksPort).probeTLS(ctx, address, sni)
+	if err != nil {
+		return nil, err
+	}
+	return state.PeerCertificates, nil
+}
+
+func ProbeCertQUIC(ctx context.Context, address, sni string, useSOCKS5 bool, socksPort int) ([]*x509.Certificate, error) {
+	state, err := newOutboundDialer(useSOCKS5, socksPort).probeQUIC(ctx, address, sni)
+	if err != nil {
+		return nil, err
+	}
+	return state.PeerCertificates, nil
+}
+
+// ProbeCertTLSWithInstance is ProbeCertTLS through the outbound of a running instance.
+func ProbeCertTLSWithInstance(ctx context.Context, instance *V2RayInstance, outboundTag, address, sni string) ([]*x509.Certificate, error) {
+	state, err := newInstanceDialer(instance, outboundTag).probeTLS(ctx, address, sni)
+	if err != nil {
+		return nil, err
+	}
+	return state.PeerCertificates, nil
+}
+
+// ProbeCertQUICWithInstance is ProbeCertQUIC through the outbound of a running instance.
+func ProbeCertQUICWithInstance(ctx context.Context, instance *V2RayInstance, outboundTag, address, sni string) ([]*x509.Certificate, error) {
+	state, err := newInstanceDialer(instance, outboundTag).probeQUIC(ctx, address, sni)
+	if err != nil {
+		return nil, err
+	}
+	return state.PeerCertificates, nil
+}
+
+func (d *outboundDialer) probeCert(address, sni, protocol string) (cert string, err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	var certs []*x509.Certificate
+	var state *tls.ConnectionState
 	switch protocol {
 	case "tls":
-		certs, err = ProbeCertTLS(ctx, address, sni, useSOCKS5, int(socksPort))
+		state, err = d.probeTLS(ctx, address, sni)
 	case "quic":
-		certs, err = ProbeCertQUIC(ctx, address, sni, useSOCKS5, int(socksPort))
+		state, err = d.probeQUIC(ctx, address, sni)
 	default:
 		err = newError("unknown protocol: ", protocol)
 	}
 	if err != nil {
 		return "", err
 	}
+	return encodeCertificates(state.PeerCertificates)
+}
+
+func ProbeCert(address, sni, protocol string, useSOCKS5 bool, socksPort int32) (cert string, err error) {
+	return newOutboundDialer(useSOCKS5, int(socksPort)).probeCert(address, sni, protocol)
+}
 
+// ProbeCertWithInstance is ProbeCert through the outbound of a running instance, so that
+// the certificate seen by the proxy path can be compared with the direct one.
+func ProbeCertWithInstance(instance *V2RayInstance, outboundTag, address, sni, protocol string) (cert string, err error) {
+	return newInstanceDialer(instance, outboundTag).probeCert(address, sni, protocol)
+}
+
+func encodeCertificates(certs []*x509.Certificate) (string, error) {
 	var builder strings.Builder
 	for _, cert := range certs {
-		err = pem.Encode(&builder, &pem.Block{
+		err := pem.Encode(&builder, &pem.Block{
 			Type:  "CERTIFICATE",
 			Bytes: cert.Raw,
 		})
@@ -120,3 +131,185 @@ func ProbeCert(address, sni, protocol string, useSOCKS5 bool, socksPort int32) (
 	}
 	return builder.String(), nil
 }
+
+type CertificateInfo struct {
+	Subject      string
+	Issuer       string
+	SerialNumber string
+	// SANs is a comma separated list of DNS names, IP addresses, email addresses and URIs
+	SANs               string
+	NotBefore          int64
+	NotAfter           int64
+	IsCA               bool
+	SignatureAlgorithm string
+	PublicKeyAlgorithm string
+	// SHA256 is the fingerprint of the certificate, in the format of HTTPClient.PinnedSHA256
+	SHA256 string
+}
+
+func newCertificateInfo(cert *x509.Certificate) *CertificateInfo {
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return &CertificateInfo{
+		Subject:            cert.Subject.String(),
+		Issuer:             cert.Issuer.String(),
+		SerialNumber:       cert.SerialNumber.Text(16),
+		SANs:               strings.Join(sans, ","),
+		NotBefore:          cert.NotBefore.Unix(),
+		NotAfter:           cert.NotAfter.Unix(),
+		IsCA:               cert.IsCA,
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+		PublicKeyAlgorithm: cert.PublicKeyAlgorithm.String(),
+		SHA256:             Sha256Hex(cert.Raw),
+	}
+}
+
+const (
+	CertVerifyOK                = "ok"
+	CertVerifyExpired           = "expired"
+	CertVerifyHostnameMismatch  = "hostname_mismatch"
+	CertVerifyUnknownAuthority  = "unknown_authority"
+	CertVerifyInvalid           = "invalid"
+	CertVerifyNoCertificate     = "no_certificate"
+	CertVerifyUnsupportedSigner = "unsupported_signer"
+)
+
+type CertProbeResult struct {
+	TLSVersion  string
+	ALPN        string
+	CipherSuite string
+	OCSPStapled bool
+	// ECHConfigList is the base64 encoded ECH config list advertised in the HTTPS record of the server,
+	// empty if none or if no DNS server is given.
+	ECHConfigList  string
+	ECHLookupError string
+
+	Verified bool
+	// VerifyReason is one of the CertVerify constants
+	VerifyReason string
+	VerifyError  string
+
+	certificates []*x509.Certificate
+}
+
+func (r *CertProbeResult) GetCertificateCount() int32 {
+	return int32(len(r.certificates))
+}
+
+func (r *CertProbeResult) GetCertificate(index int32) *CertificateInfo {
+	if index < 0 || int(index) >= len(r.certificates) {
+		return nil
+	}
+	return newCertificateInfo(r.certificates[index])
+}
+
+func (r *CertProbeResult) GetPEM() (string, error) {
+	return encodeCertificates(r.certificates)
+}
+
+func newCertProbeResult(state *tls.ConnectionState, serverName string) *CertProbeResult {
+	result := &CertProbeResult{
+		TLSVersion:   tls.VersionName(state.Version),
+		ALPN:         state.NegotiatedProtocol,
+		CipherSuite:  tls.CipherSuiteName(state.CipherSuite),
+		OCSPStapled:  len(state.OCSPResponse) > 0,
+		certificates: state.PeerCertificates,
+	}
+	result.VerifyReason, result.VerifyError = verifyCertificates(state.PeerCertificates, serverName)
+	result.Verified = result.VerifyReason == CertVerifyOK
+	return result
+}
+
+func verifyCertificates(certs []*x509.Certificate, serverName string) (reason string, message string) {
+	if len(certs) == 0 {
+		return CertVerifyNoCertificate, "no certificate presented"
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Intermediates: intermediates,
+	})
+	if err == nil {
+		return CertVerifyOK, ""
+	}
+	var (
+		invalidError          x509.CertificateInvalidError
+		hostnameError         x509.HostnameError
+		unknownAuthorityError x509.UnknownAuthorityError
+		insecureAlgorithm     x509.InsecureAlgorithmError
+	)
+	switch {
+	case errors.As(err, &invalidError) && invalidError.Reason == x509.Expired:
+		reason = CertVerifyExpired
+	case errors.As(err, &invalidError):
+		reason = CertVerifyInvalid
+	case errors.As(err, &hostnameError):
+		reason = CertVerifyHostnameMismatch
+	case errors.As(err, &unknownAuthorityError):
+		reason = CertVerifyUnknownAuthority
+	case errors.As(err, &insecureAlgorithm), errors.Is(err, x509.ErrUnsupportedAlgorithm):
+		reason = CertVerifyUnsupportedSigner
+	default:
+		reason = CertVerifyInvalid
+	}
+	return reason, err.Error()
+}
+
+func (d *outboundDialer) probeCertificate(ctx context.Context, address, sni, protocol, dnsServer string) (*CertProbeResult, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	serverName := sni
+	if serverName == "" {
+		serverName = host
+	}
+
+	var state *tls.ConnectionState
+	switch protocol {
+	case "tls":
+		state, err = d.probeTLS(ctx, address, sni)
+	case "quic":
+		state, err = d.probeQUIC(ctx, address, sni)
+	default:
+		err = newError("unknown protocol: ", protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := newCertProbeResult(state, serverName)
+	if dnsServer != "" && net.ParseIP(serverName) == nil {
+		echConfigList, err := d.lookupECHConfigList(ctx, dnsServer, serverName, port)
+		if err != nil {
+			result.ECHLookupError = err.Error()
+		} else if len(echConfigList) > 0 {
+			result.ECHConfigList = base64.StdEncoding.EncodeToString(echConfigList)
+		}
+	}
+	return result, nil
+}
+
+// ProbeCertificate probes the certificate chain of the server, and checks it against the current root store.
+// If dnsServer (host:port, queried over TCP) is not empty, it is used to look up the ECH config of the server.
+func ProbeCertificate(address, sni, protocol string, useSOCKS5 bool, socksPort int32, dnsServer string) (*CertProbeResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return newOutboundDialer(useSOCKS5, int(socksPort)).probeCertificate(ctx, address, sni, protocol, dnsServer)
+}
+
+func ProbeCertificateWithInstance(instance *V2RayInstance, outboundTag, address, sni, protocol, dnsServer string) (*CertProbeResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return newInstanceDialer(instance, outboundTag).probeCertificate(ctx, address, sni, protocol, dnsServer)
+}
@@ -0,0 +1,336 @@
+package libcore
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type clashConfig struct {
+	Proxies     []yaml.Node `yaml:"proxies"`
+	ProxyGroups []yaml.Node `yaml:"proxy-groups"`
+}
+
+type clashProxy struct {
+	Name     string `yaml:"name"`
+	Type     string `yaml:"type"`
+	Server   string `yaml:"server"`
+	Port     string `yaml:"port"`
+	UUID     string `yaml:"uuid"`
+	Password string `yaml:"password"`
+	Cipher   string `yaml:"cipher"`
+
+	Plugin     string            `yaml:"plugin"`
+	PluginOpts map[string]string `yaml:"plugin-opts"`
+
+	// shadowsocksr, and obfs of hysteria2
+	Obfs          string `yaml:"obfs"`
+	ObfsParam     string `yaml:"obfs-param"`
+	ObfsPassword  string `yaml:"obfs-password"`
+	Protocol      string `yaml:"protocol"`
+	ProtocolParam string `yaml:"protocol-param"`
+
+	// hysteria2
+	Ports string `yaml:"ports"`
+	Up    string `yaml:"up"`
+	Down  string `yaml:"down"`
+
+	Network           string   `yaml:"network"`
+	TLS               bool     `yaml:"tls"`
+	ServerName        string   `yaml:"servername"`
+	SNI               string   `yaml:"sni"`
+	ALPN              []string `yaml:"alpn"`
+	ClientFingerprint string   `yaml:"client-fingerprint"`
+	Flow              string   `yaml:"flow"`
+	// RealityOpts uses strings so that short ids like 0123 keep their digits.
+	RealityOpts *struct {
+		PublicKey string `yaml:"public-key"`
+		ShortID   string `yaml:"short-id"`
+	} `yaml:"reality-opts"`
+
+	WSOpts struct {
+		Path                string            `yaml:"path"`
+		Headers             map[string]string `yaml:"headers"`
+		MaxEarlyData        int32             `yaml:"max-early-data"`
+		EarlyDataHeaderName string            `yaml:"early-data-header-name"`
+		HTTPUpgrade         bool              `yaml:"v2ray-http-upgrade"`
+	} `yaml:"ws-opts"`
+	H2Opts struct {
+		Host []string `yaml:"host"`
+		Path string   `yaml:"path"`
+	} `yaml:"h2-opts"`
+	GRPCOpts struct {
+		ServiceName string `yaml:"grpc-service-name"`
+	} `yaml:"grpc-opts"`
+}
+
+type clashProxyGroup struct {
+	Name    string   `yaml:"name"`
+	Type    string   `yaml:"type"`
+	Proxies []string `yaml:"proxies"`
+	Use     []string `yaml:"use"`
+}
+
+// ParseClashConfig converts the proxies of a Clash config into V2Ray v5 JSON outbounds,
+// and its url-test, fallback and load-balance proxy groups into v5 balancing rules.
+// Unsupported proxies and groups are listed in Skipped.
+func ParseClashConfig(content string) (*SubscriptionResult, error) {
+	var config clashConfig
+	if err := yaml.Unmarshal([]byte(content), &config); err != nil {
+		return nil, newError("failed to parse clash config").Base(err)
+	}
+	if len(config.Proxies) == 0 {
+		return nil, newError("no proxies found in clash config")
+	}
+
+	result := new(SubscriptionResult)
+	// proxyTags are the outbound tags of proxies by name, duplicated names get unique tags.
+	proxyTags := make(map[string][]string)
+	usedTags := make(map[string]bool)
+	for index, node := range config.Proxies {
+		var proxy clashProxy
+		if err := node.Decode(&proxy); err != nil {
+			result.skip("proxies["+strconv.Itoa(index)+"]", err)
+			continue
+		}
+		server, err := proxy.proxyServer()
+		if err != nil {
+			result.skip(proxy.Name, err)
+			continue
+		}
+		for i := 2; usedTags[server.Name]; i++ {
+			server.Name = proxy.Name + " " + strconv.Itoa(i)
+		}
+		count := len(result.outbounds)
+		result.add(server)
+		if len(result.outbounds) > count {
+			proxyTags[proxy.Name] = append(proxyTags[proxy.Name], server.Name)
+			usedTags[server.Name] = true
+		}
+	}
+
+	groups := make(map[string]*clashProxyGroup)
+	var groupOrder []*clashProxyGroup
+	for index, node := range config.ProxyGroups {
+		group := new(clashProxyGroup)
+		if err := node.Decode(group); err != nil {
+			result.skip("proxy-groups["+strconv.Itoa(index)+"]", err)
+			continue
+		}
+		groups[group.Name] = group
+		groupOrder = append(groupOrder, group)
+	}
+	for _, group := range groupOrder {
+		rule, err := clashBalancingRule(group, groups, proxyTags)
+		if err != nil {
+			result.skip(group.Name, err)
+			continue
+		}
+		result.balancingRules = append(result.balancingRules, rule)
+	}
+	return result.build()
+}
+
+func clashBalancingRule(group *clashProxyGroup, groups map[string]*clashProxyGroup, proxyTags map[string][]string) (*v5BalancingRule, error) {
+	rule := &v5BalancingRule{Tag: group.Name}
+	switch group.Type {
+	case "url-test", "fallback":
+		rule.Strategy = "leastping"
+	case "load-balance":
+		rule.Strategy = "random"
+	case "select":
+		return nil, newError("select groups are chosen manually and have no balancer equivalent")
+	default:
+		return nil, newError("unsupported proxy group type: ", group.Type)
+	}
+	if len(group.Use) > 0 {
+		return nil, newError("proxy providers are not supported")
+	}
+	rule.OutboundSelector = expandClashGroup(group, groups, proxyTags, make(map[string]bool))
+	if len(rule.OutboundSelector) == 0 {
+		return nil, newError("no supported proxy in group")
+	}
+	return rule, nil
+}
+
+// expandClashGroup resolves nested groups into the tags of converted proxies, DIRECT and REJECT are dropped.
+func expandClashGroup(group *clashProxyGroup, groups map[string]*clashProxyGroup, proxyTags map[string][]string, visited map[string]bool) []string {
+	visited[group.Name] = true
+	var tags []string
+	for _, name := range group.Proxies {
+		if proxyTags[name] != nil {
+			tags = append(tags, proxyTags[name]...)
+		} else if nested, ok := groups[name]; ok && !visited[name] {
+			tags = append(tags, expandClashGroup(nested, groups, proxyTags, visited)...)
+		}
+	}
+	return tags
+}
+
+func (p *clashProxy) proxyServer() (*proxyServer, error) {
+	s := &proxyServer{
+		Name:        p.Name,
+		Address:     p.Server,
+		UUID:        p.UUID,
+		Password:    p.Password,
+		ServerName:  p.ServerName,
+		ALPN:        p.ALPN,
+		Fingerprint: p.ClientFingerprint,
+	}
+	if p.Type == "hysteria2" && p.Port == "" {
+		p.Port = "443"
+	}
+	if p.Ports != "" {
+		return nil, newError("port hopping is not supported")
+	}
+	var err error
+	if s.Port, err = parsePort(p.Port); err != nil {
+		return nil, err
+	}
+	switch p.Type {
+	case "ss":
+		s.Protocol = "shadowsocks"
+		s.Method = strings.ToLower(p.Cipher)
+		if strings.HasPrefix(s.Method, "2022-") {
+			s.Protocol = "shadowsocks2022"
+		}
+		opts := p.PluginOpts
+		switch p.Plugin {
+		case "obfs":
+			err = s.setPlugin("obfs-local", encodePluginOptions("obfs", opts["mode"], "obfs-host", opts["host"]))
+		case "v2ray-plugin":
+			err = s.setPlugin("v2ray-plugin", encodePluginOptions(
+				"mode", opts["mode"], "tls", opts["tls"], "host", opts["host"], "path", opts["path"]))
+		default:
+			err = s.setPlugin(p.Plugin, "")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "ssr":
+		s.Protocol = "shadowsocks"
+		s.Method = strings.ToLower(p.Cipher)
+		s.Plugin = "shadowsocksr"
+		s.PluginArgs = []string{
+			"--protocol=" + p.Protocol,
+			"--protocol-param=" + p.ProtocolParam,
+			"--obfs=" + p.Obfs,
+			"--obfs-param=" + p.ObfsParam,
+		}
+		return s, nil
+	case "hysteria2":
+		s.Protocol = "hysteria2"
+		s.Security = "tls"
+		s.ServerName = p.SNI
+		if p.Obfs != "" {
+			s.ObfsType = p.Obfs
+			s.ObfsPassword = p.ObfsPassword
+		}
+		if s.UpMbps, err = parseClashBandwidth(p.Up); err != nil {
+			return nil, err
+		}
+		if s.DownMbps, err = parseClashBandwidth(p.Down); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "vmess":
+		s.Protocol = "vmess"
+	case "vless":
+		s.Protocol = "vless"
+		if p.Flow != "" {
+			return nil, newError("unsupported vless flow: ", p.Flow)
+		}
+	case "trojan":
+		s.Protocol = "trojan"
+		p.TLS = true
+		if s.ServerName == "" {
+			s.ServerName = p.SNI
+		}
+	default:
+		return nil, newError("unsupported proxy type: ", p.Type)
+	}
+
+	if p.TLS {
+		s.Security = "tls"
+	}
+	if p.RealityOpts != nil {
+		s.Security = "reality"
+		s.PublicKey = p.RealityOpts.PublicKey
+		s.ShortID = p.RealityOpts.ShortID
+	}
+	switch p.Network {
+	case "", "tcp":
+	case "ws":
+		s.Transport = "ws"
+		if p.WSOpts.HTTPUpgrade {
+			s.Transport = "httpupgrade"
+		}
+		s.Path = p.WSOpts.Path
+		for key, value := range p.WSOpts.Headers {
+			if strings.EqualFold(key, "Host") {
+				s.Host = value
+			}
+		}
+		s.MaxEarlyData = p.WSOpts.MaxEarlyData
+		s.EarlyDataHeaderName = p.WSOpts.EarlyDataHeaderName
+		if s.MaxEarlyData > 0 && s.EarlyDataHeaderName == "" {
+			s.EarlyDataHeaderName = "Sec-WebSocket-Protocol"
+		}
+	case "h2":
+		s.Transport = "h2"
+		s.Host = strings.Join(p.H2Opts.Host, ",")
+		s.Path = p.H2Opts.Path
+	case "grpc":
+		s.Transport = "grpc"
+		s.ServiceName = p.GRPCOpts.ServiceName
+	default:
+		return nil, newError("unsupported network: ", p.Network)
+	}
+	return s, nil
+}
+
+// clashBandwidthUnits are the bits per second of bandwidth units in lower case, numbers without a unit are in Mbps.
+var clashBandwidthUnits = map[string]float64{
+	"":     1e6,
+	"b":    1,
+	"bps":  1,
+	"k":    1e3,
+	"kb":   1e3,
+	"kbps": 1e3,
+	"m":    1e6,
+	"mb":   1e6,
+	"mbps": 1e6,
+	"g":    1e9,
+	"gb":   1e9,
+	"gbps": 1e9,
+	"t":    1e12,
+	"tb":   1e12,
+	"tbps": 1e12,
+}
+
+// parseClashBandwidth parses bandwidth like "100 Mbps", "1 Gbps", "500 kbps" or "100M" into Mbps.
+// Fractions of Mbps are rounded up, so that low bandwidth is not taken as unset.
+func parseClashBandwidth(bandwidth string) (uint64, error) {
+	bandwidth = strings.TrimSpace(bandwidth)
+	if bandwidth == "" {
+		return 0, nil
+	}
+	unitStart := strings.IndexFunc(bandwidth, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if unitStart < 0 {
+		unitStart = len(bandwidth)
+	}
+	bitsPerSecond, ok := clashBandwidthUnits[strings.ToLower(strings.TrimSpace(bandwidth[unitStart:]))]
+	if !ok {
+		return 0, newError("unknown bandwidth unit: ", bandwidth)
+	}
+	value, err := strconv.ParseFloat(bandwidth[:unitStart], 64)
+	if err != nil {
+		return 0, newError("invalid bandwidth: ", bandwidth)
+	}
+	return uint64(math.Ceil(value * bitsPerSecond / 1e6)), nil
+}
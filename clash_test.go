@@ -0,0 +1,91 @@
+package libcore
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/v2fly/v2ray-core/v5"
+)
+
+func TestParseClashBandwidth(t *testing.T) {
+	tests := []struct {
+		bandwidth string
+		mbps      uint64
+		ok        bool
+	}{
+		{"", 0, true},
+		{"100", 100, true},
+		{"100 Mbps", 100, true},
+		{"100 mbps", 100, true},
+		{"100M", 100, true},
+		{"1 Gbps", 1000, true},
+		{"1.5G", 1500, true},
+		{"500 Kbps", 1, true},
+		{"100000000 bps", 100, true},
+		{"100 MB/s", 0, false},
+		{"fast", 0, false},
+		{"1.2.3 Mbps", 0, false},
+	}
+	for _, test := range tests {
+		mbps, err := parseClashBandwidth(test.bandwidth)
+		if (err == nil) != test.ok || mbps != test.mbps {
+			t.Errorf("%q: got %d, %v", test.bandwidth, mbps, err)
+		}
+	}
+}
+
+func TestParseClashConfig(t *testing.T) {
+	config := `
+proxies:
+  - {name: hy2, type: hysteria2, server: example.com, password: password, up: "100 mbps", down: "1 Gbps"}
+  - {name: hy2 slow, type: hysteria2, server: example.com, password: password, up: "500 Kbps", down: 100M}
+  - {name: hy2 bogus, type: hysteria2, server: example.com, password: password, up: "10 furlongs"}
+  - name: node
+    type: vmess
+    server: a.example.com
+    port: 443
+    uuid: ` + testUUID + `
+    network: ws
+    tls: true
+    ws-opts: {path: /ws, headers: {Host: cdn.example.com}}
+  - {name: node, type: trojan, server: b.example.com, port: 443, password: password}
+  - {name: node 2, type: trojan, server: c.example.com, port: 443, password: password}
+proxy-groups:
+  - {name: auto, type: url-test, proxies: [node, hy2, DIRECT]}
+  - {name: manual, type: select, proxies: [auto]}
+`
+	result, err := ParseClashConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var outbounds []struct {
+		Tag string `json:"tag"`
+	}
+	if err = json.Unmarshal([]byte(result.Outbounds), &outbounds); err != nil {
+		t.Fatal(err)
+	}
+	var tags []string
+	for _, outbound := range outbounds {
+		tags = append(tags, outbound.Tag)
+	}
+	if got := strings.Join(tags, ","); got != "hy2,hy2 slow,node,node 2,node 2 2" {
+		t.Errorf("got tags %s", got)
+	}
+	for _, fragment := range []string{`"upMbps":100,"downMbps":1000`, `"upMbps":1,"downMbps":100`} {
+		if !strings.Contains(result.Outbounds, fragment) {
+			t.Errorf("%s not found in %s", fragment, result.Outbounds)
+		}
+	}
+	if skipped := strings.Split(result.Skipped, "\n"); len(skipped) != 2 ||
+		!strings.HasPrefix(skipped[0], "hy2 bogus:") || !strings.HasPrefix(skipped[1], "manual:") {
+		t.Errorf("got skipped %q", result.Skipped)
+	}
+	if result.BalancingRules != `[{"tag":"auto","outboundSelector":["node","node 2","hy2"],"strategy":"leastping"}]` {
+		t.Errorf("got balancing rules %s", result.BalancingRules)
+	}
+	if _, err = core.LoadConfig(ConfigFormatJSONv5, bytes.NewReader([]byte(`{"outbounds":`+result.Outbounds+`}`))); err != nil {
+		t.Errorf("failed to load %s: %v", result.Outbounds, err)
+	}
+}
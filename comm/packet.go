@@ -0,0 +1,116 @@
+package comm
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+type packet struct {
+	data []byte
+	addr net.Addr
+}
+
+type deadlinePacketConn struct {
+	net.PacketConn
+
+	packets chan packet
+	done    chan struct{}
+	closed  sync.Once
+	err     error
+
+	access   sync.Mutex
+	deadline time.Time
+	changed  chan struct{}
+}
+
+// DeadlinePacketConn adds read deadline support to packet conns which ignore SetReadDeadline,
+// such as the ones created by the v2ray dispatcher.
+func DeadlinePacketConn(conn net.PacketConn) net.PacketConn {
+	c := &deadlinePacketConn{
+		PacketConn: conn,
+		packets:    make(chan packet),
+		done:       make(chan struct{}),
+		changed:    make(chan struct{}),
+	}
+	go c.loop()
+	return c
+}
+
+func (c *deadlinePacketConn) loop() {
+	buffer := make([]byte, 65535)
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buffer)
+		if err != nil {
+			c.access.Lock()
+			c.err = err
+			c.access.Unlock()
+			c.closed.Do(func() { close(c.done) })
+			return
+		}
+		select {
+		case c.packets <- packet{append([]byte(nil), buffer[:n]...), addr}:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *deadlinePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		c.access.Lock()
+		deadline, changed := c.deadline, c.changed
+		c.access.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		select {
+		case pk := <-c.packets:
+			stopTimer(timer)
+			return copy(p, pk.data), pk.addr, nil
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-changed:
+			stopTimer(timer)
+		case <-c.done:
+			stopTimer(timer)
+			c.access.Lock()
+			err := c.err
+			c.access.Unlock()
+			if err != nil {
+				return 0, nil, err
+			}
+			return 0, nil, net.ErrClosed
+		}
+	}
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+func (c *deadlinePacketConn) SetDeadline(t time.Time) error {
+	_ = c.PacketConn.SetWriteDeadline(t)
+	return c.SetReadDeadline(t)
+}
+
+func (c *deadlinePacketConn) SetReadDeadline(t time.Time) error {
+	c.access.Lock()
+	c.deadline = t
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.access.Unlock()
+	return nil
+}
+
+func (c *deadlinePacketConn) Close() error {
+	c.closed.Do(func() { close(c.done) })
+	return c.PacketConn.Close()
+}
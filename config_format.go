@@ -0,0 +1,133 @@
+package libcore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/BurntSushi/toml"
+	"github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/infra/conf/serial"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ConfigFormatAuto = "auto"
+	// ConfigFormatJSON is V2Ray v4 JSON, with comments and JSON5 syntax allowed.
+	ConfigFormatJSON   = "json"
+	ConfigFormatJSONv5 = "jsonv5"
+	// ConfigFormatYAML and ConfigFormatTOML are V2Ray v4 configs written in YAML or TOML.
+	ConfigFormatYAML     = "yaml"
+	ConfigFormatTOML     = "toml"
+	ConfigFormatProtobuf = "protobuf"
+)
+
+// detectConfigFormat guesses the format of a config. JSON is taken as v5 only with a router and without routing,
+// as the v4 loader silently ignores the v5 fields.
+func detectConfigFormat(content []byte) string {
+	if !utf8.Valid(content) || bytes.IndexByte(content, 0) >= 0 {
+		return ConfigFormatProtobuf
+	}
+	text := strings.TrimSpace(strings.TrimPrefix(string(content), "\uFEFF"))
+	if text == "" || strings.HasPrefix(text, "{") || strings.HasPrefix(text, "//") || strings.HasPrefix(text, "/*") {
+		normalized, err := NormalizeJSON(text)
+		if err != nil {
+			return ConfigFormatJSON
+		}
+		var root map[string]json.RawMessage
+		if json.Unmarshal([]byte(normalized), &root) == nil {
+			_, hasRouter := root["router"]
+			_, hasRouting := root["routing"]
+			if hasRouter && !hasRouting {
+				return ConfigFormatJSONv5
+			}
+		}
+		return ConfigFormatJSON
+	}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return ConfigFormatTOML
+		}
+		if key, _, found := strings.Cut(line, "="); found && !strings.ContainsAny(key, ":{}") {
+			return ConfigFormatTOML
+		}
+		break
+	}
+	return ConfigFormatYAML
+}
+
+// configToJSON converts a v4 config in JSON, YAML or TOML to standard JSON.
+func configToJSON(content []byte, format string) ([]byte, error) {
+	switch format {
+	case ConfigFormatJSON:
+		normalized, err := NormalizeJSON(string(content))
+		if err != nil {
+			return nil, err
+		}
+		return []byte(normalized), nil
+	case ConfigFormatYAML:
+		var value interface{}
+		if err := yaml.Unmarshal(content, &value); err != nil {
+			return nil, err
+		}
+		return json.Marshal(yamlToJSONValue(value))
+	case ConfigFormatTOML:
+		value := make(map[string]interface{})
+		if err := toml.Unmarshal(content, &value); err != nil {
+			return nil, err
+		}
+		return json.Marshal(value)
+	default:
+		return nil, newError("config format ", format, " is not a v4 config format")
+	}
+}
+
+// yamlToJSONValue converts maps with non-string keys, which encoding/json rejects.
+func yamlToJSONValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = yamlToJSONValue(item)
+		}
+		return value
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			converted[fmt.Sprint(key)] = yamlToJSONValue(item)
+		}
+		return converted
+	case []interface{}:
+		for i, item := range value {
+			value[i] = yamlToJSONValue(item)
+		}
+		return value
+	default:
+		return value
+	}
+}
+
+func loadCoreConfig(content []byte, format string) (*core.Config, error) {
+	if format == "" || format == ConfigFormatAuto {
+		format = detectConfigFormat(content)
+	}
+	switch format {
+	case ConfigFormatJSON, ConfigFormatYAML, ConfigFormatTOML:
+		content, err := configToJSON(content, format)
+		if err != nil {
+			return nil, newError("failed to parse ", format, " config").Base(err)
+		}
+		return serial.LoadJSONConfig(bytes.NewReader(content))
+	case ConfigFormatJSONv5:
+		return core.LoadConfig(ConfigFormatJSONv5, bytes.NewReader(content))
+	case ConfigFormatProtobuf:
+		return core.LoadConfig(core.FormatProtobuf, bytes.NewReader(content))
+	default:
+		return nil, newError("unknown config format: ", format)
+	}
+}
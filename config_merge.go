@@ -0,0 +1,186 @@
+package libcore
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/v2fly/v2ray-core/v5/infra/conf/merge"
+)
+
+// ConfigFragments is a list of v4 configs in JSON, YAML or TOML to be merged in order,
+// objects are merged, arrays are appended, and array items with the same tag are merged with later values taking precedence.
+// Items are sorted by the _priority field, and the _tag field can be used to merge items without a tag.
+//
+// Once a variable is set or the environment is enabled, ${NAME} and ${NAME:-default} in string values
+// are replaced before merging, and $$ is a literal $.
+type ConfigFragments struct {
+	contents [][]byte
+	formats  []string
+
+	variables      map[string]string
+	useEnvironment bool
+}
+
+func NewConfigFragments() *ConfigFragments {
+	return new(ConfigFragments)
+}
+
+// Add appends a fragment, format is one of the ConfigFormat constants except jsonv5 and protobuf.
+func (f *ConfigFragments) Add(content string, format string) {
+	f.contents = append(f.contents, []byte(content))
+	f.formats = append(f.formats, format)
+}
+
+func (f *ConfigFragments) GetCount() int32 {
+	return int32(len(f.contents))
+}
+
+func (f *ConfigFragments) SetVariable(name string, value string) {
+	if f.variables == nil {
+		f.variables = make(map[string]string)
+	}
+	f.variables[name] = value
+}
+
+// SetUseEnvironment looks up the variables not set by SetVariable in the environment of the process.
+func (f *ConfigFragments) SetUseEnvironment(useEnvironment bool) {
+	f.useEnvironment = useEnvironment
+}
+
+// Merge returns the merged config as indented JSON with sorted keys, which can be passed to LoadConfig.
+func (f *ConfigFragments) Merge() (string, error) {
+	target, err := f.mergeToMap()
+	if err != nil {
+		return "", err
+	}
+	buffer := new(bytes.Buffer)
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(target); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+func (f *ConfigFragments) merge() ([]byte, error) {
+	target, err := f.mergeToMap()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(target)
+}
+
+func (f *ConfigFragments) mergeToMap() (map[string]interface{}, error) {
+	target := make(map[string]interface{})
+	for i, content := range f.contents {
+		format := f.formats[i]
+		if format == "" || format == ConfigFormatAuto {
+			format = detectConfigFormat(content)
+		}
+		if format == ConfigFormatJSONv5 || format == ConfigFormatProtobuf {
+			return nil, newError("config fragment ", i, ": ", format, " configs cannot be merged")
+		}
+		content, err := configToJSON(content, format)
+		if err != nil {
+			return nil, newError("failed to parse config fragment ", i).Base(err)
+		}
+		if f.variables != nil || f.useEnvironment {
+			if content, err = f.substituteJSON(content); err != nil {
+				return nil, newError("config fragment ", i).Base(err)
+			}
+		}
+		if _, err = merge.ToMap(content, target); err != nil {
+			return nil, newError("failed to merge config fragment ", i).Base(err)
+		}
+	}
+	if err := merge.ApplyRules(target); err != nil {
+		return nil, newError("failed to merge config fragments").Base(err)
+	}
+	return target, nil
+}
+
+func (f *ConfigFragments) substituteJSON(content []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	value, err := f.substituteValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+func (f *ConfigFragments) substituteValue(value interface{}) (interface{}, error) {
+	var err error
+	switch value := value.(type) {
+	case string:
+		return f.substitute(value)
+	case map[string]interface{}:
+		for key, item := range value {
+			if value[key], err = f.substituteValue(item); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			if value[i], err = f.substituteValue(item); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return value, nil
+}
+
+func (f *ConfigFragments) lookupVariable(name string) (string, bool) {
+	if value, ok := f.variables[name]; ok {
+		return value, true
+	}
+	if f.useEnvironment {
+		return os.LookupEnv(name)
+	}
+	return "", false
+}
+
+func (f *ConfigFragments) substitute(value string) (string, error) {
+	if !strings.Contains(value, "$") {
+		return value, nil
+	}
+	var builder strings.Builder
+	for {
+		index := strings.IndexByte(value, '$')
+		if index < 0 || index == len(value)-1 {
+			builder.WriteString(value)
+			return builder.String(), nil
+		}
+		builder.WriteString(value[:index])
+		switch value[index+1] {
+		case '$':
+			builder.WriteByte('$')
+			value = value[index+2:]
+		case '{':
+			end := strings.IndexByte(value[index:], '}')
+			if end < 0 {
+				return "", newError("unterminated variable in ", value)
+			}
+			name, defaultValue, hasDefault := strings.Cut(value[index+2:index+end], ":-")
+			variable, ok := f.lookupVariable(name)
+			if !ok {
+				if !hasDefault {
+					return "", newError("undefined variable: ", name)
+				}
+				variable = defaultValue
+			}
+			builder.WriteString(variable)
+			value = value[index+end+1:]
+		default:
+			builder.WriteByte('$')
+			value = value[index+1:]
+		}
+	}
+}
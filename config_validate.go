@@ -0,0 +1,603 @@
+package libcore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+	"unsafe"
+
+	"github.com/v2fly/v2ray-core/v5/infra/conf/cfgcommon"
+	"github.com/v2fly/v2ray-core/v5/infra/conf/cfgcommon/loader"
+	v4 "github.com/v2fly/v2ray-core/v5/infra/conf/v4"
+)
+
+const (
+	ConfigDiagnosticError   = "error"
+	ConfigDiagnosticWarning = "warning"
+)
+
+type ConfigDiagnostic struct {
+	// Path is the location in the config like outbounds[3].streamSettings, empty for the whole config.
+	Path string
+	// Line and Column start from 1, columns are counted in characters.
+	Line    int32
+	Column  int32
+	Message string
+	// Severity is one of the ConfigDiagnostic constants, the config fails to load if there is any error.
+	Severity string
+
+	offset int
+}
+
+type ConfigValidationResult struct {
+	Valid bool
+
+	diagnostics []*ConfigDiagnostic
+}
+
+func (r *ConfigValidationResult) GetDiagnosticCount() int32 {
+	return int32(len(r.diagnostics))
+}
+
+func (r *ConfigValidationResult) GetDiagnostic(index int32) *ConfigDiagnostic {
+	if index < 0 || int(index) >= len(r.diagnostics) {
+		return nil
+	}
+	return r.diagnostics[index]
+}
+
+// ValidateConfig checks a V2Ray v4 JSON config as accepted by LoadConfig without creating an instance,
+// reporting syntax and build errors, unknown fields and missing geosite and geoip categories.
+func ValidateConfig(content string) *ConfigValidationResult {
+	v := &configValidator{
+		result:        new(ConfigValidationResult),
+		geoCategories: make(map[string]map[string]bool),
+		geoFailed:     make(map[string]bool),
+	}
+	v.validate(content)
+	sort.SliceStable(v.result.diagnostics, func(i, j int) bool {
+		return v.result.diagnostics[i].offset < v.result.diagnostics[j].offset
+	})
+	v.result.Valid = true
+	for _, diagnostic := range v.result.diagnostics {
+		if diagnostic.Severity == ConfigDiagnosticError {
+			v.result.Valid = false
+		}
+	}
+	return v.result
+}
+
+// jsonNode is a parsed JSON value with its offsets in the normalized content.
+type jsonNode struct {
+	start int
+	end   int
+	// keyStart is the offset of the key for object members.
+	keyStart int
+	// kind is '{', '[', '"' or 0 for other values.
+	kind     byte
+	value    string
+	keys     []string
+	children []*jsonNode
+}
+
+// child finds an object member, matching the key case-insensitively as encoding/json does.
+func (n *jsonNode) child(key string) (*jsonNode, string) {
+	var found *jsonNode
+	var foundKey string
+	for i, k := range n.keys {
+		if k == key {
+			return n.children[i], k
+		}
+		if found == nil && strings.EqualFold(k, key) {
+			found, foundKey = n.children[i], k
+		}
+	}
+	return found, foundKey
+}
+
+func (n *jsonNode) childPath(index int, path string) string {
+	if n.kind == '[' {
+		return path + "[" + strconv.Itoa(index) + "]"
+	}
+	if path == "" {
+		return n.keys[index]
+	}
+	return path + "." + n.keys[index]
+}
+
+// find returns the innermost node containing offset and its path.
+func (n *jsonNode) find(offset int, path string) (*jsonNode, string) {
+	for i, child := range n.children {
+		if offset >= child.start && offset < child.end {
+			return child.find(offset, n.childPath(i, path))
+		}
+	}
+	return n, path
+}
+
+type configValidator struct {
+	// content is the normalized input, positions are reported in input through offsets.
+	content    string
+	input      string
+	offsets    *jsonOffsetMap
+	lineStarts []int
+	result     *ConfigValidationResult
+
+	// geoCategories caches the lower cased categories of dat files, nil if the file failed to load.
+	geoCategories map[string]map[string]bool
+	// geoFailed marks the top level sections with geo errors, these are not built to avoid duplicate errors.
+	geoFailed map[string]bool
+}
+
+func (v *configValidator) validate(content string) {
+	normalized, offsets, err := normalizeJSON(content, true)
+	if err != nil {
+		var syntaxError *JSONSyntaxError
+		if errors.As(err, &syntaxError) {
+			v.result.diagnostics = append(v.result.diagnostics, &ConfigDiagnostic{
+				Line:     syntaxError.Line,
+				Column:   syntaxError.Column,
+				Message:  syntaxError.Message,
+				Severity: ConfigDiagnosticError,
+			})
+			return
+		}
+		v.add(nil, "", ConfigDiagnosticError, err.Error())
+		return
+	}
+	v.content = normalized
+	v.input = content
+	v.offsets = offsets
+	v.lineStarts = []int{0}
+	for i := 0; i < len(content); i++ {
+		if content[i] == '\n' {
+			v.lineStarts = append(v.lineStarts, i+1)
+		}
+	}
+
+	root, err := v.parse()
+	if err != nil {
+		var syntaxError *json.SyntaxError
+		offset := len(v.content)
+		if errors.As(err, &syntaxError) {
+			offset = int(syntaxError.Offset)
+		}
+		v.addAt(offset, "", ConfigDiagnosticError, strings.TrimPrefix(err.Error(), "json: "))
+		return
+	}
+	if root.kind != '{' {
+		v.add(root, "", ConfigDiagnosticError, "config must be a JSON object")
+		return
+	}
+
+	v.checkFields(root, reflect.TypeOf(v4.Config{}), "")
+	v.checkGeoReferences(root)
+	v.build(root)
+}
+
+// position returns the line and column in the input of an offset in the normalized content.
+func (v *configValidator) position(offset int) (int32, int32) {
+	if v.offsets != nil {
+		offset = v.offsets.inputOffset(offset)
+	}
+	line := sort.Search(len(v.lineStarts), func(i int) bool {
+		return v.lineStarts[i] > offset
+	}) - 1
+	if line < 0 {
+		line = 0
+	}
+	if offset > len(v.input) {
+		offset = len(v.input)
+	}
+	column := utf8.RuneCountInString(v.input[v.lineStarts[line]:offset]) + 1
+	return int32(line + 1), int32(column)
+}
+
+func (v *configValidator) addAt(offset int, path, severity, message string) {
+	line, column := v.position(offset)
+	v.result.diagnostics = append(v.result.diagnostics, &ConfigDiagnostic{
+		Path:     path,
+		Line:     line,
+		Column:   column,
+		Message:  message,
+		Severity: severity,
+		offset:   offset,
+	})
+}
+
+func (v *configValidator) add(node *jsonNode, path, severity, message string) {
+	offset := 0
+	if node != nil {
+		offset = node.start
+	}
+	v.addAt(offset, path, severity, message)
+}
+
+func (v *configValidator) addError(node *jsonNode, path string, err error) {
+	v.add(node, path, ConfigDiagnosticError, strings.Join(strings.Fields(err.Error()), " "))
+}
+
+func (v *configValidator) parse() (*jsonNode, error) {
+	decoder := json.NewDecoder(strings.NewReader(v.content))
+	decoder.UseNumber()
+	root, err := v.parseNode(decoder)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = decoder.Token(); err != io.EOF {
+		return nil, &json.SyntaxError{Offset: decoder.InputOffset()}
+	}
+	return root, nil
+}
+
+// skipSeparators moves past the spaces, colons and commas the decoder has not consumed yet.
+func (v *configValidator) skipSeparators(offset int) int {
+	for offset < len(v.content) {
+		switch v.content[offset] {
+		case ' ', '\t', '\r', '\n', ':', ',':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+func (v *configValidator) parseNode(decoder *json.Decoder) (*jsonNode, error) {
+	node := &jsonNode{start: v.skipSeparators(int(decoder.InputOffset()))}
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token := token.(type) {
+	case json.Delim:
+		node.kind = byte(token)
+		for decoder.More() {
+			keyStart := v.skipSeparators(int(decoder.InputOffset()))
+			if node.kind == '{' {
+				key, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				node.keys = append(node.keys, key.(string))
+			}
+			child, err := v.parseNode(decoder)
+			if err != nil {
+				return nil, err
+			}
+			child.keyStart = keyStart
+			node.children = append(node.children, child)
+		}
+		if _, err = decoder.Token(); err != nil {
+			return nil, err
+		}
+	case string:
+		node.kind = '"'
+		node.value = token
+	}
+	node.end = int(decoder.InputOffset())
+	return node, nil
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// jsonFieldTypes maps the lower cased JSON names of the fields of a struct type, including promoted fields, to their types.
+func jsonFieldTypes(t reflect.Type, fields map[string]reflect.Type) map[string]reflect.Type {
+	if fields == nil {
+		fields = make(map[string]reflect.Type)
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			jsonFieldTypes(fieldType, fields)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if _, exists := fields[strings.ToLower(name)]; !exists {
+			fields[strings.ToLower(name)] = field.Type
+		}
+	}
+	return fields
+}
+
+// checkFields reports object members not known to the config type, types decoding themselves are not inspected.
+func (v *configValidator) checkFields(node *jsonNode, t reflect.Type, path string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Implements(jsonUnmarshalerType) || reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.kind != '{' {
+			return
+		}
+		fields := jsonFieldTypes(t, nil)
+		for i, key := range node.keys {
+			fieldType, ok := fields[strings.ToLower(key)]
+			if !ok {
+				v.addAt(node.children[i].keyStart, node.childPath(i, path), ConfigDiagnosticWarning, fmt.Sprintf("unknown field %q", key))
+				continue
+			}
+			v.checkFields(node.children[i], fieldType, node.childPath(i, path))
+		}
+	case reflect.Slice, reflect.Array:
+		if node.kind != '[' || t.Elem().Kind() == reflect.Uint8 {
+			return
+		}
+		for i, child := range node.children {
+			v.checkFields(child, t.Elem(), node.childPath(i, path))
+		}
+	case reflect.Map:
+		if node.kind != '{' {
+			return
+		}
+		for i, child := range node.children {
+			v.checkFields(child, t.Elem(), node.childPath(i, path))
+		}
+	}
+}
+
+// checkGeoReferences looks up the geosite, geoip and external dat file categories used in routing and dns.
+func (v *configValidator) checkGeoReferences(root *jsonNode) {
+	for i, key := range root.keys {
+		section := strings.ToLower(key)
+		if section != "routing" && section != "dns" {
+			continue
+		}
+		v.walkGeoReferences(root.children[i], key, section)
+	}
+}
+
+func (v *configValidator) walkGeoReferences(node *jsonNode, path, section string) {
+	if node.kind == '"' {
+		v.checkGeoReference(node.value, node.start, path, section)
+		return
+	}
+	for i, child := range node.children {
+		childPath := node.childPath(i, path)
+		if node.kind == '{' {
+			// hosts of dns may be matched by geosite
+			v.checkGeoReference(node.keys[i], child.keyStart, childPath, section)
+		}
+		v.walkGeoReferences(child, childPath, section)
+	}
+}
+
+// geoReference parses rule values like geosite:cn@ads, geoip:!cn and ext:file.dat:category.
+func geoReference(value string) (file, category string) {
+	switch {
+	case strings.HasPrefix(value, "geosite:"):
+		file, category = geositeDat, value[len("geosite:"):]
+	case strings.HasPrefix(value, "geoip:"):
+		file, category = geoipDat, value[len("geoip:"):]
+	default:
+		for _, prefix := range []string{"ext:", "ext-domain:", "ext-ip:"} {
+			if strings.HasPrefix(value, prefix) {
+				file, category, _ = strings.Cut(value[len(prefix):], ":")
+				break
+			}
+		}
+	}
+	category, _, _ = strings.Cut(strings.TrimPrefix(category, "!"), "@")
+	return file, strings.TrimSpace(category)
+}
+
+func (v *configValidator) checkGeoReference(value string, offset int, path, section string) {
+	file, category := geoReference(value)
+	if file == "" || category == "" {
+		return
+	}
+	categories, loaded := v.geoCategories[file]
+	if !loaded {
+		codes, err := listGeoFileCategories(file)
+		if err != nil {
+			v.geoCategories[file] = nil
+			v.geoFailed[section] = true
+			v.addAt(offset, path, ConfigDiagnosticError, "failed to read "+file+": "+err.Error())
+			return
+		}
+		categories = make(map[string]bool, len(codes))
+		for _, code := range codes {
+			categories[strings.ToLower(code)] = true
+		}
+		v.geoCategories[file] = categories
+	}
+	if categories == nil {
+		v.geoFailed[section] = true
+		return
+	}
+	if !categories[strings.ToLower(category)] {
+		v.geoFailed[section] = true
+		v.addAt(offset, path, ConfigDiagnosticError, fmt.Sprintf("category %q not found in %s", category, file))
+	}
+}
+
+func (v *configValidator) decode(node *jsonNode, path string, target interface{}) bool {
+	err := json.Unmarshal([]byte(v.content[node.start:node.end]), target)
+	if err == nil {
+		return true
+	}
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &typeError) && typeError.Offset > 0 {
+		// the offset is after the mismatched value
+		inner, innerPath := node.find(node.start+int(typeError.Offset)-1, path)
+		v.add(inner, innerPath, ConfigDiagnosticError, fmt.Sprintf("cannot unmarshal %s into %s", typeError.Value, typeError.Type))
+		return false
+	}
+	v.addError(node, path, err)
+	return false
+}
+
+// build decodes and builds the inbounds, outbounds, routing and dns one by one to locate errors,
+// then builds the rest of the config.
+func (v *configValidator) build(root *jsonNode) {
+	config := new(v4.Config)
+	value := reflect.ValueOf(config).Elem()
+	fields := make(map[string]reflect.Value)
+	for i := 0; i < value.NumField(); i++ {
+		name, _, _ := strings.Cut(value.Type().Field(i).Tag.Get("json"), ",")
+		fields[strings.ToLower(name)] = value.Field(i)
+	}
+	nodes := make(map[string]*jsonNode)
+	for i, key := range root.keys {
+		node := root.children[i]
+		field, ok := fields[strings.ToLower(key)]
+		if !ok {
+			continue
+		}
+		nodes[strings.ToLower(key)] = node
+		switch field.Addr().Interface().(type) {
+		case *[]v4.InboundDetourConfig:
+			if node.kind == '[' {
+				for j, child := range node.children {
+					v.buildInbound(child, node.childPath(j, key))
+				}
+				continue
+			}
+		case *[]v4.OutboundDetourConfig:
+			if node.kind == '[' {
+				for j, child := range node.children {
+					v.buildOutbound(child, node.childPath(j, key))
+				}
+				continue
+			}
+		case **v4.InboundDetourConfig:
+			v.buildInbound(node, key)
+			continue
+		case **v4.OutboundDetourConfig:
+			v.buildOutbound(node, key)
+			continue
+		}
+		v.decode(node, key, field.Addr().Interface())
+	}
+
+	if config.RouterConfig != nil && !v.geoFailed["routing"] {
+		if _, err := config.RouterConfig.Build(); err != nil {
+			v.addError(nodes["routing"], "routing", err)
+		}
+	}
+	if config.FakeDNS != nil && config.DNSConfig != nil {
+		config.DNSConfig.FakeDNS = config.FakeDNS
+		config.FakeDNS = nil
+	}
+	if config.DNSConfig != nil && !v.geoFailed["dns"] {
+		if _, err := config.DNSConfig.Build(); err != nil {
+			v.addError(nodes["dns"], "dns", err)
+		}
+	}
+	config.RouterConfig = nil
+	config.DNSConfig = nil
+	if _, err := config.Build(); err != nil {
+		v.addError(root, "", err)
+	}
+}
+
+//go:linkname inboundConfigLoader github.com/v2fly/v2ray-core/v5/infra/conf/v4.inboundConfigLoader
+var inboundConfigLoader *loader.JSONConfigLoader
+
+//go:linkname outboundConfigLoader github.com/v2fly/v2ray-core/v5/infra/conf/v4.outboundConfigLoader
+var outboundConfigLoader *loader.JSONConfigLoader
+
+var (
+	inboundSettingTypes  = settingTypes(inboundConfigLoader)
+	outboundSettingTypes = settingTypes(outboundConfigLoader)
+)
+
+// settingTypes maps the protocols of a v4 config loader to the types it decodes their settings into.
+func settingTypes(configLoader *loader.JSONConfigLoader) map[string]reflect.Type {
+	field := reflect.ValueOf(configLoader).Elem().FieldByName("cache")
+	cache := reflect.NewAt(field.Type(), unsafe.Pointer(field.UnsafeAddr())).Elem().Interface().(loader.ConfigCreatorCache)
+	types := make(map[string]reflect.Type, len(cache))
+	for protocol, creator := range cache {
+		types[protocol] = reflect.TypeOf(creator()).Elem()
+	}
+	return types
+}
+
+// buildSettings checks and builds the protocol settings of an inbound or outbound.
+func (v *configValidator) buildSettings(node *jsonNode, path, protocol string, types map[string]reflect.Type) bool {
+	t, ok := types[strings.ToLower(protocol)]
+	if !ok {
+		protocolNode, key := node.child("protocol")
+		if protocolNode == nil {
+			v.add(node, path, ConfigDiagnosticError, "missing protocol")
+		} else {
+			v.add(protocolNode, path+"."+key, ConfigDiagnosticError, "unknown protocol: "+protocol)
+		}
+		return false
+	}
+	settingsNode, key := node.child("settings")
+	if settingsNode == nil || settingsNode.kind != '{' {
+		return true
+	}
+	path += "." + key
+	v.checkFields(settingsNode, t, path)
+	settings := reflect.New(t).Interface()
+	if !v.decode(settingsNode, path, settings) {
+		return false
+	}
+	if _, err := settings.(cfgcommon.Buildable).Build(); err != nil {
+		v.addError(settingsNode, path, err)
+		return false
+	}
+	return true
+}
+
+func (v *configValidator) buildStreamSettings(node *jsonNode, path string, streamSettings *v4.StreamConfig) bool {
+	if streamSettings == nil {
+		return true
+	}
+	if _, err := streamSettings.Build(); err != nil {
+		streamNode, key := node.child("streamSettings")
+		v.addError(streamNode, path+"."+key, err)
+		return false
+	}
+	return true
+}
+
+func (v *configValidator) buildInbound(node *jsonNode, path string) {
+	config := new(v4.InboundDetourConfig)
+	if !v.decode(node, path, config) {
+		return
+	}
+	if !v.buildStreamSettings(node, path, config.StreamSetting) || !v.buildSettings(node, path, config.Protocol, inboundSettingTypes) {
+		return
+	}
+	if _, err := config.Build(); err != nil {
+		v.addError(node, path, err)
+	}
+}
+
+func (v *configValidator) buildOutbound(node *jsonNode, path string) {
+	config := new(v4.OutboundDetourConfig)
+	if !v.decode(node, path, config) {
+		return
+	}
+	if !v.buildStreamSettings(node, path, config.StreamSetting) || !v.buildSettings(node, path, config.Protocol, outboundSettingTypes) {
+		return
+	}
+	if _, err := config.Build(); err != nil {
+		v.addError(node, path, err)
+	}
+}
@@ -0,0 +1,90 @@
+package libcore
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateConfigPosition(t *testing.T) {
+	tests := []struct {
+		config string
+		path   string
+		line   int32
+		column int32
+	}{
+		{
+			config: `{ /* a long block comment here */ "outbounds": [{"protocol": "freedom", "bogus": 1}]}`,
+			path:   "outbounds[0].bogus",
+			line:   1,
+			column: 73,
+		},
+		{
+			config: "// comment\n{\n  outbounds: [{protocol: 'freedom', /* x */ bogus: 1}],\n}",
+			path:   "outbounds[0].bogus",
+			line:   3,
+			column: 45,
+		},
+		{
+			config: "{\"log\": {\"loglevel\": \"a\\\n\"}, \"bogus\": 1}",
+			path:   "bogus",
+			line:   2,
+			column: 5,
+		},
+	}
+	for _, test := range tests {
+		result := ValidateConfig(test.config)
+		if result.GetDiagnosticCount() != 1 {
+			t.Errorf("%q: got %d diagnostics", test.config, result.GetDiagnosticCount())
+			continue
+		}
+		diagnostic := result.GetDiagnostic(0)
+		if diagnostic.Path != test.path || diagnostic.Line != test.line || diagnostic.Column != test.column {
+			t.Errorf("%q: got %s at %d:%d, want %s at %d:%d", test.config,
+				diagnostic.Path, diagnostic.Line, diagnostic.Column, test.path, test.line, test.column)
+		}
+	}
+}
+
+func TestValidateConfigProtocols(t *testing.T) {
+	tests := []struct {
+		inbound  bool
+		protocol string
+		settings string
+	}{
+		{true, "dokodemo-door", `{"address": "1.1.1.1", "port": 53, "network": "tcp,udp"}`},
+		{true, "socks", `{"auth": "noauth", "udp": true}`},
+		{true, "http", `{"accounts": [{"user": "user", "pass": "pass"}]}`},
+		{true, "mixed", `{"auth": "noauth"}`},
+		{true, "vmess", `{"clients": [{"id": "` + testUUID + `"}]}`},
+		{false, "freedom", `{"domainStrategy": "UseIP"}`},
+		{false, "blackhole", `{"response": {"type": "http"}}`},
+		{false, "vmess", `{"vnext": [{"address": "example.com", "port": 443, "users": [{"id": "` + testUUID + `"}]}]}`},
+		{false, "vless", `{"vnext": [{"address": "example.com", "port": 443, "users": [{"id": "` + testUUID + `", "encryption": "none"}]}]}`},
+		{false, "trojan", `{"servers": [{"address": "example.com", "port": 443, "password": "password"}]}`},
+		{false, "shadowsocks", `{"servers": [{"address": "example.com", "port": 8388, "method": "aes-256-gcm", "password": "password"}]}`},
+		{false, "socks", `{"servers": [{"address": "127.0.0.1", "port": 1080}]}`},
+	}
+	for _, test := range tests {
+		path, listen := "outbounds[0]", ""
+		if test.inbound {
+			path, listen = "inbounds[0]", `"port": 1080, `
+		}
+		detour := `{` + listen + `"protocol": "` + test.protocol + `", "settings": ` + test.settings + `}`
+		config := `{"` + strings.TrimSuffix(path, "[0]") + `": [` + detour + `]}`
+		if result := ValidateConfig(config); result.GetDiagnosticCount() != 0 {
+			t.Errorf("%s: got %s", config, result.GetDiagnostic(0).Message)
+		}
+
+		// members of the settings are checked against the type registered for the protocol
+		config = strings.Replace(config, `"settings": {`, `"settings": {"bogus": 1, `, 1)
+		result := ValidateConfig(config)
+		if result.GetDiagnosticCount() != 1 || result.GetDiagnostic(0).Path != path+".settings.bogus" {
+			t.Errorf("%s: bogus member not reported", config)
+		}
+	}
+
+	result := ValidateConfig(`{"outbounds": [{"protocol": "bogus"}]}`)
+	if result.GetDiagnosticCount() != 1 || result.GetDiagnostic(0).Path != "outbounds[0].protocol" {
+		t.Error("unknown protocol not reported")
+	}
+}
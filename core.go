@@ -1,8 +1,12 @@
 package libcore
 
 import (
+	"context"
+	"net"
 	"os"
+	"time"
 
+	gostun "github.com/ccding/go-stun/stun"
 	"libcore/stun"
 )
 
@@ -23,22 +27,78 @@ func IcmpPing(address string, timeout int32) (int32, error) {
 type StunResult struct {
 	NatMapping   string
 	NatFiltering string
-	Error        string
+	NatType      string
+
+	MappedAddress          string
+	MappedAddressOtherIP   string
+	MappedAddressOtherAddr string
+
+	NoNat       bool
+	Hairpinning bool
+	// BindingLifetime in seconds, 0 if not tested
+	BindingLifetime int32
+
+	Error string
 }
 
-func StunTest(serverAddress string, useSOCKS5 bool, socksPort int32, dnsPort int32) *StunResult {
+func newStunResult(natBehavior *stun.Behavior, err error) *StunResult {
 	result := new(StunResult)
-	natBehavior, err := stun.Test(serverAddress, useSOCKS5, int(socksPort), int(dnsPort))
 	if err != nil {
 		result.Error = err.Error()
 	}
 	if natBehavior != nil {
 		result.NatMapping = natBehavior.MappingType.String()
 		result.NatFiltering = natBehavior.FilteringType.String()
+		result.NatType = natBehavior.NormalType()
+		if natBehavior.MappedAddress != nil {
+			result.MappedAddress = natBehavior.MappedAddress.String()
+		}
+		if natBehavior.MappedAddressOtherIP != nil {
+			result.MappedAddressOtherIP = natBehavior.MappedAddressOtherIP.String()
+		}
+		if natBehavior.MappedAddressOtherAddr != nil {
+			result.MappedAddressOtherAddr = natBehavior.MappedAddressOtherAddr.String()
+		}
+		result.NoNat = natBehavior.NoNAT
+		result.Hairpinning = natBehavior.Hairpinning
+		result.BindingLifetime = int32(natBehavior.BindingLifetime / time.Second)
 	}
 	return result
 }
 
+// StunTest runs the RFC 5780 behavior discovery.
+func StunTest(serverAddress string, useSOCKS5 bool, socksPort int32, dnsPort int32) *StunResult {
+	return newStunResult(stun.Test(serverAddress, useSOCKS5, int(socksPort), int(dnsPort)))
+}
+
+// StunTestWithBindingLifetime is StunTest with the binding lifetime estimation, which waits up to bindingLifetimeMax seconds in total.
+func StunTestWithBindingLifetime(serverAddress string, useSOCKS5 bool, socksPort int32, dnsPort int32, bindingLifetimeMax int32) *StunResult {
+	return newStunResult(stun.TestWithBindingLifetime(serverAddress, useSOCKS5, int(socksPort), int(dnsPort), time.Duration(bindingLifetimeMax)*time.Second))
+}
+
+// stunOptions sends the domain of the STUN server to the outbound, so that it is not resolved outside of it.
+func (instance *V2RayInstance) stunOptions(outboundTag string) *stun.Options {
+	return &stun.Options{
+		ListenPacket: func(addrStr string) (net.PacketConn, error) {
+			host, _, err := net.SplitHostPort(addrStr)
+			if err != nil {
+				return nil, err
+			}
+			return instance.dialDomainPacketConn(context.Background(), outboundTag, host)
+		},
+		Resolve: func(string) (net.IP, error) {
+			return domainPlaceholderIP, nil
+		},
+	}
+}
+
+// StunTestWithInstance runs StunTest through the outbound of a running instance instead of a local SOCKS port.
+func StunTestWithInstance(instance *V2RayInstance, outboundTag string, serverAddress string, bindingLifetimeMax int32) *StunResult {
+	options := instance.stunOptions(outboundTag)
+	options.BindingLifetimeMax = time.Duration(bindingLifetimeMax) * time.Second
+	return newStunResult(stun.TestWithOptions(serverAddress, options))
+}
+
 type StunLegacyResult struct {
 	NatType string
 	Host    string
@@ -46,8 +106,15 @@ type StunLegacyResult struct {
 }
 
 func StunLegacyTest(serverAddress string, useSOCKS5 bool, socksPort int32, dnsPort int32) *StunLegacyResult {
+	return newStunLegacyResult(stun.TestLegacy(serverAddress, useSOCKS5, int(socksPort), int(dnsPort)))
+}
+
+func StunLegacyTestWithInstance(instance *V2RayInstance, outboundTag string, serverAddress string) *StunLegacyResult {
+	return newStunLegacyResult(stun.TestLegacyWithOptions(serverAddress, instance.stunOptions(outboundTag)))
+}
+
+func newStunLegacyResult(natType *gostun.NATType, host *gostun.Host, err error) *StunLegacyResult {
 	result := new(StunLegacyResult)
-	natType, host, err := stun.TestLegacy(serverAddress, useSOCKS5, int(socksPort), int(dnsPort))
 	if err != nil {
 		result.Error = err.Error()
 	}
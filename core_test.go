@@ -0,0 +1,43 @@
+package libcore
+
+import (
+	"net"
+	"testing"
+
+	"libcore/stun"
+)
+
+func TestStunWithInstanceDomain(t *testing.T) {
+	server, err := stun.ListenServer("127.0.0.1", "127.0.0.2")
+	if err != nil {
+		t.Skip("loopback alias unavailable: ", err)
+	}
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Addr())
+
+	// the domain is routed to freedom only if it reaches the router unresolved
+	instance := NewV2rayInstance()
+	err = instance.LoadConfig(`{
+		"dns": {"hosts": {"stun.test": "127.0.0.1"}},
+		"outbounds": [
+			{"protocol": "blackhole", "tag": "block"},
+			{"protocol": "freedom", "tag": "direct", "settings": {"domainStrategy": "UseIPv4"}}
+		],
+		"routing": {"rules": [{"type": "field", "domain": ["full:stun.test"], "outboundTag": "direct"}]}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = instance.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+
+	result := StunTestWithInstance(instance, "", "stun.test:"+port, 0)
+	if result.Error != "" {
+		t.Fatal(result.Error)
+	}
+	if host, _, _ := net.SplitHostPort(result.MappedAddress); host != "127.0.0.1" {
+		t.Errorf("got mapped address %s", result.MappedAddress)
+	}
+}
@@ -0,0 +1,83 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v5/common/net"
+	"github.com/wzshiming/socks5"
+)
+
+// outboundDialer dials directly, through the local SOCKS5 inbound or through an outbound of an instance.
+type outboundDialer struct {
+	dialContext  func(ctx context.Context, network, address string) (net.Conn, error)
+	listenPacket func(ctx context.Context, address string) (net.PacketConn, net.Addr, error)
+}
+
+func newOutboundDialer(useSOCKS5 bool, socksPort int) *outboundDialer {
+	if useSOCKS5 {
+		dialer, _ := socks5.NewDialer("socks5h://127.0.0.1:" + strconv.Itoa(socksPort))
+		return &outboundDialer{
+			dialContext: dialer.DialContext,
+			listenPacket: func(ctx context.Context, address string) (net.PacketConn, net.Addr, error) {
+				conn, err := dialer.DialContext(ctx, "udp", address)
+				if err != nil {
+					return nil, nil, err
+				}
+				return conn.(*socks5.UDPConn), &udpAddr{address: address}, nil
+			},
+		}
+	}
+	dialer := new(net.Dialer)
+	return &outboundDialer{
+		dialContext: dialer.DialContext,
+		listenPacket: func(ctx context.Context, address string) (net.PacketConn, net.Addr, error) {
+			packetConn, err := net.ListenUDP("udp", nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			addr, err := net.ResolveUDPAddr("udp", address)
+			if err != nil {
+				packetConn.Close()
+				return nil, nil, err
+			}
+			return packetConn, addr, nil
+		},
+	}
+}
+
+func newInstanceDialer(instance *V2RayInstance, outboundTag string) *outboundDialer {
+	return &outboundDialer{
+		dialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			destination, err := v2rayNet.ParseDestination(network + ":" + address)
+			if err != nil {
+				return nil, err
+			}
+			return instance.dialContext(contextWithOutbound(ctx, outboundTag), destination)
+		},
+		listenPacket: func(ctx context.Context, address string) (net.PacketConn, net.Addr, error) {
+			addr, err := instance.resolveUDPAddr(address)
+			if err != nil {
+				return nil, nil, err
+			}
+			packetConn, err := instance.dialPacketConn(ctx, outboundTag)
+			if err != nil {
+				return nil, nil, err
+			}
+			return packetConn, addr, nil
+		},
+	}
+}
+
+type udpAddr struct {
+	address string
+}
+
+func (a *udpAddr) Network() string {
+	return "udp"
+}
+
+func (a *udpAddr) String() string {
+	return a.address
+}
@@ -1,6 +1,11 @@
 package libcore
 
 import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
 	"net/netip"
 	"strings"
 
@@ -95,3 +100,134 @@ func DecodeContentDomainNameSystemResponse(content []byte) (response string, err
 	}
 	return
 }
+
+const typeHTTPS = dnsmessage.Type(65)
+
+func encodeHTTPSQuery(domain string) ([]byte, error) {
+	if !strings.HasSuffix(domain, ".") {
+		domain = domain + "."
+	}
+	name, err := dnsmessage.NewName(domain)
+	if err != nil {
+		return nil, newError("domain name too long").Base(err)
+	}
+	message := new(dnsmessage.Message)
+	message.Header.ID = uint16(rand.Uint32())
+	message.Header.RecursionDesired = true
+	message.Questions = []dnsmessage.Question{{
+		Name:  name,
+		Type:  typeHTTPS,
+		Class: dnsmessage.ClassINET,
+	}}
+	return message.Pack()
+}
+
+// parseECHConfigList returns the ech SvcParam of the first HTTPS record which has one.
+func parseECHConfigList(content []byte) ([]byte, error) {
+	parser := new(dnsmessage.Parser)
+	header, err := parser.Start(content)
+	if err != nil {
+		return nil, newError("failed to parse DNS response").Base(err)
+	}
+	if header.RCode != dnsmessage.RCodeSuccess && header.RCode != dnsmessage.RCodeNameError {
+		return nil, newError("rcode: ", header.RCode.String())
+	}
+	if err = parser.SkipAllQuestions(); err != nil {
+		return nil, newError("failed to skip questions in DNS response").Base(err)
+	}
+	for {
+		answerHeader, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			return nil, nil
+		} else if err != nil {
+			return nil, newError("failed to parse answer section").Base(err)
+		}
+		if answerHeader.Type != typeHTTPS {
+			if err = parser.SkipAnswer(); err != nil {
+				return nil, newError("failed to skip answer").Base(err)
+			}
+			continue
+		}
+		resource, err := parser.UnknownResource()
+		if err != nil {
+			return nil, newError("failed to parse HTTPS record").Base(err)
+		}
+		if echConfigList := findSvcParam(resource.Data, 5); echConfigList != nil {
+			return echConfigList, nil
+		}
+	}
+}
+
+func findSvcParam(data []byte, key uint16) []byte {
+	// SvcPriority
+	if len(data) < 2 {
+		return nil
+	}
+	data = data[2:]
+	// TargetName, uncompressed
+	for {
+		if len(data) < 1 {
+			return nil
+		}
+		labelLength := int(data[0])
+		if len(data) < 1+labelLength {
+			return nil
+		}
+		data = data[1+labelLength:]
+		if labelLength == 0 {
+			break
+		}
+	}
+	for len(data) >= 4 {
+		paramKey := binary.BigEndian.Uint16(data)
+		paramLength := int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+paramLength {
+			return nil
+		}
+		if paramKey == key {
+			return data[4 : 4+paramLength]
+		}
+		data = data[4+paramLength:]
+	}
+	return nil
+}
+
+func (d *outboundDialer) lookupECHConfigList(ctx context.Context, dnsServer, domain, port string) ([]byte, error) {
+	if port != "443" {
+		domain = "_" + port + "._https." + domain
+	}
+	query, err := encodeHTTPSQuery(domain)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := d.dialContext(ctx, "tcp", dnsServer)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	response, err := exchangeStream(ctx, conn, query)
+	if err != nil {
+		return nil, err
+	}
+	return parseECHConfigList(response)
+}
+
+// exchangeStream sends a DNS query over a stream connection, such as TCP or TLS, and returns the response.
+func exchangeStream(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	_, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...))
+	if err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err = io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err = io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
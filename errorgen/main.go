@@ -38,7 +38,7 @@ func newError(values ...interface{}) *errors.Error {
 }
 
 func newErrorf(format string, a ...interface{}) *errors.Error {
-	return errors.New(fmt.Sprintf(format, a)).WithPathObj(errPathObjHolder{})
+	return errors.New(fmt.Sprintf(format, a...)).WithPathObj(errPathObjHolder{})
 }
 
 `, pkg)
@@ -0,0 +1,329 @@
+package libcore
+
+import (
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+)
+
+// GeoSiteBuilder compiles domain lists into a geosite dat file, to be used in rules as ext:file.dat:category.
+type GeoSiteBuilder struct {
+	sites []*routercommon.GeoSite
+	// seen holds the rules added to each category as category, type and value
+	seen map[string]bool
+}
+
+func NewGeoSiteBuilder() *GeoSiteBuilder {
+	return &GeoSiteBuilder{seen: make(map[string]bool)}
+}
+
+func (b *GeoSiteBuilder) site(category string) *routercommon.GeoSite {
+	code := strings.ToUpper(category)
+	for _, site := range b.sites {
+		if site.CountryCode == code {
+			return site
+		}
+	}
+	site := &routercommon.GeoSite{CountryCode: code}
+	b.sites = append(b.sites, site)
+	return site
+}
+
+func (b *GeoSiteBuilder) add(site *routercommon.GeoSite, domain *routercommon.Domain) {
+	key := site.CountryCode + "\x00" + domain.Type.String() + "\x00" + domain.Value
+	if b.seen[key] {
+		return
+	}
+	b.seen[key] = true
+	site.Domain = append(site.Domain, domain)
+}
+
+// parseGeoSiteRule parses a line in the format of domain-list-community, like full:example.com @ads.
+// A domain without a type matches its subdomains, and keyword matches a substring.
+func parseGeoSiteRule(line string) (*routercommon.Domain, error) {
+	fields := strings.Fields(line)
+	domain := new(routercommon.Domain)
+	rule := fields[0]
+	typeName, value, found := strings.Cut(rule, ":")
+	if !found {
+		typeName, value = "domain", rule
+	}
+	switch typeName {
+	case "domain":
+		domain.Type = routercommon.Domain_RootDomain
+	case "full":
+		domain.Type = routercommon.Domain_Full
+	case "keyword":
+		domain.Type = routercommon.Domain_Plain
+	case "regexp":
+		domain.Type = routercommon.Domain_Regex
+		if _, err := regexp.Compile(value); err != nil {
+			return nil, newError("invalid regexp: ", value).Base(err)
+		}
+	default:
+		return nil, newError("unknown rule type: ", typeName)
+	}
+	if value == "" {
+		return nil, newError("empty rule: ", rule)
+	}
+	if domain.Type != routercommon.Domain_Regex {
+		value = strings.ToLower(value)
+	}
+	domain.Value = value
+	for _, attribute := range fields[1:] {
+		key, ok := strings.CutPrefix(attribute, "@")
+		if !ok || key == "" {
+			return nil, newError("invalid attribute: ", attribute)
+		}
+		domain.Attribute = append(domain.Attribute, &routercommon.Domain_Attribute{
+			Key:        key,
+			TypedValue: &routercommon.Domain_Attribute_BoolValue{BoolValue: true},
+		})
+	}
+	return domain, nil
+}
+
+// cutRuleComment removes a comment starting with # at the start of the line or after whitespace,
+// so that # in rules like regexp:a#b is kept.
+func cutRuleComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		if line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// AddRules adds newline separated rules to a category, # at the start of a line or after whitespace starts a comment.
+// Rules are domain:, full:, keyword: or regexp: followed by the value, and optionally attributes like @ads.
+func (b *GeoSiteBuilder) AddRules(category string, rules string) error {
+	if category == "" {
+		return newError("empty category")
+	}
+	var domains []*routercommon.Domain
+	for index, line := range strings.Split(rules, "\n") {
+		line = cutRuleComment(line)
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		domain, err := parseGeoSiteRule(line)
+		if err != nil {
+			return newError("line ", index+1).Base(err)
+		}
+		domains = append(domains, domain)
+	}
+	site := b.site(category)
+	for _, domain := range domains {
+		b.add(site, domain)
+	}
+	return nil
+}
+
+// ImportCategory merges a category of an existing geosite file into the category named as, or the same name if empty.
+func (b *GeoSiteBuilder) ImportCategory(fileName string, category string, as string) error {
+	entry, err := findGeoEntry(fileName, category)
+	if err != nil {
+		return err
+	}
+	var imported routercommon.GeoSite
+	if err = proto.Unmarshal(entry, &imported); err != nil {
+		return newError("failed to decode category ", category).Base(err)
+	}
+	if as == "" {
+		as = category
+	}
+	site := b.site(as)
+	for _, domain := range imported.Domain {
+		b.add(site, domain)
+	}
+	return nil
+}
+
+func (b *GeoSiteBuilder) GetCategoryCount() int32 {
+	return int32(len(b.sites))
+}
+
+// Write saves the categories to fileName in the external assets directory.
+func (b *GeoSiteBuilder) Write(fileName string) error {
+	content, err := proto.Marshal(&routercommon.GeoSiteList{Entry: b.sites})
+	if err != nil {
+		return err
+	}
+	if err = writeAssetFile(fileName, content); err != nil {
+		return err
+	}
+	// the file is written, a missing index is only slower to read and rebuilt when opened
+	if err = writeGeoIndex(externalAssetsPath + fileName); err != nil {
+		logrus.Warn(newError("failed to index ", fileName).Base(err))
+	}
+	return nil
+}
+
+// GeoIPBuilder compiles IP lists into a geoip dat file, to be used in rules as ext:file.dat:category.
+type GeoIPBuilder struct {
+	entries []*routercommon.GeoIP
+	seen    map[string]bool
+}
+
+func NewGeoIPBuilder() *GeoIPBuilder {
+	return &GeoIPBuilder{seen: make(map[string]bool)}
+}
+
+func (b *GeoIPBuilder) entry(category string) *routercommon.GeoIP {
+	code := strings.ToUpper(category)
+	for _, entry := range b.entries {
+		if entry.CountryCode == code {
+			return entry
+		}
+	}
+	entry := &routercommon.GeoIP{CountryCode: code}
+	b.entries = append(b.entries, entry)
+	return entry
+}
+
+func (b *GeoIPBuilder) add(entry *routercommon.GeoIP, prefix netip.Prefix) {
+	prefix = prefix.Masked()
+	key := entry.CountryCode + "\x00" + prefix.String()
+	if b.seen[key] {
+		return
+	}
+	b.seen[key] = true
+	entry.Cidr = append(entry.Cidr, &routercommon.CIDR{
+		Ip:     prefix.Addr().AsSlice(),
+		Prefix: uint32(prefix.Bits()),
+	})
+}
+
+// AddCIDRs adds newline separated CIDRs or IP addresses to a category, # starts a comment like in AddRules.
+func (b *GeoIPBuilder) AddCIDRs(category string, cidrs string) error {
+	if category == "" {
+		return newError("empty category")
+	}
+	var prefixes []netip.Prefix
+	for index, line := range strings.Split(cidrs, "\n") {
+		line = cutRuleComment(line)
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var prefix netip.Prefix
+		var err error
+		if strings.Contains(line, "/") {
+			prefix, err = netip.ParsePrefix(line)
+		} else {
+			var address netip.Addr
+			if address, err = netip.ParseAddr(line); err == nil {
+				prefix = netip.PrefixFrom(address, address.BitLen())
+			}
+		}
+		if err != nil {
+			return newError("line ", index+1, ": invalid cidr: ", line).Base(err)
+		}
+		if prefix.Addr().Is4In6() {
+			if prefix.Bits() < 96 {
+				return newError("line ", index+1, ": invalid cidr: ", line)
+			}
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	entry := b.entry(category)
+	for _, prefix := range prefixes {
+		b.add(entry, prefix)
+	}
+	return nil
+}
+
+// ImportCategory merges a category of an existing geoip file into the category named as, or the same name if empty.
+func (b *GeoIPBuilder) ImportCategory(fileName string, category string, as string) error {
+	raw, err := findGeoEntry(fileName, category)
+	if err != nil {
+		return err
+	}
+	var imported routercommon.GeoIP
+	if err = proto.Unmarshal(raw, &imported); err != nil {
+		return newError("failed to decode category ", category).Base(err)
+	}
+	if imported.InverseMatch {
+		return newError("category ", category, " is inverse matched")
+	}
+	if as == "" {
+		as = category
+	}
+	entry := b.entry(as)
+	for _, cidr := range imported.Cidr {
+		address, ok := netip.AddrFromSlice(cidr.Ip)
+		if !ok {
+			continue
+		}
+		if prefix, err := address.Prefix(int(cidr.Prefix)); err == nil {
+			b.add(entry, prefix)
+		}
+	}
+	return nil
+}
+
+func (b *GeoIPBuilder) GetCategoryCount() int32 {
+	return int32(len(b.entries))
+}
+
+// Write saves the categories to fileName in the external assets directory.
+func (b *GeoIPBuilder) Write(fileName string) error {
+	content, err := proto.Marshal(&routercommon.GeoIPList{Entry: b.entries})
+	if err != nil {
+		return err
+	}
+	if err = writeAssetFile(fileName, content); err != nil {
+		return err
+	}
+	// the file is written, a missing index is only slower to read and rebuilt when opened
+	if err = writeGeoIndex(externalAssetsPath + fileName); err != nil {
+		logrus.Warn(newError("failed to index ", fileName).Base(err))
+	}
+	return nil
+}
+
+// writeAssetFile replaces a file in the external assets directory through a temporary file.
+func writeAssetFile(fileName string, content []byte) error {
+	if externalAssetsPath == "" {
+		return newError("assets are not initialized")
+	}
+	if fileName == "" || strings.ContainsAny(fileName, `/\`) {
+		return newError("invalid file name: ", fileName)
+	}
+	path := externalAssetsPath + fileName
+	file, err := os.CreateTemp(externalAssetsPath, fileName+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0o644)
+	}
+	if err == nil {
+		// a bundled file replaced here is no longer checked against its sum
+		err = os.Remove(path + assetChecksumSuffix)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+		verifiedAssets.Delete(path)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+	}
+	return err
+}
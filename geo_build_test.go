@@ -0,0 +1,50 @@
+package libcore
+
+import (
+	"os"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+)
+
+func TestGeoSiteBuilder(t *testing.T) {
+	dir := initializeTestAssets(t)
+	builder := NewGeoSiteBuilder()
+	rules := "# comment\nregexp:^a#b$\ndomain:example.com # comment\n\tfull:www.example.org\t# comment"
+	if err := builder.AddRules("test", rules); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.AddRules("test", "bogus:example.com"); err == nil {
+		t.Error("unknown rule type added")
+	}
+
+	// the file is written even if it can not be indexed
+	if err := os.Mkdir(dir+"custom.dat"+geoIndexSuffix, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Write("custom.dat"); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := findGeoEntry("custom.dat", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var site routercommon.GeoSite
+	if err = proto.Unmarshal(entry, &site); err != nil {
+		t.Fatal(err)
+	}
+	want := []*routercommon.Domain{
+		{Type: routercommon.Domain_Regex, Value: "^a#b$"},
+		{Type: routercommon.Domain_RootDomain, Value: "example.com"},
+		{Type: routercommon.Domain_Full, Value: "www.example.org"},
+	}
+	if len(site.Domain) != len(want) {
+		t.Fatalf("got %v", site.Domain)
+	}
+	for i, domain := range site.Domain {
+		if !proto.Equal(domain, want[i]) {
+			t.Errorf("rule %d: got %v, want %v", i, domain, want[i])
+		}
+	}
+}
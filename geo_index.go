@@ -0,0 +1,327 @@
+package libcore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+	"github.com/v2fly/v2ray-core/v5/common/platform"
+	"github.com/v2fly/v2ray-core/v5/common/platform/filesystem"
+	"github.com/v2fly/v2ray-core/v5/infra/conf/geodata"
+	"github.com/v2fly/v2ray-core/v5/infra/conf/geodata/memconservative"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// geoIndexSuffix is appended to the path of a dat file for its index, which has a header line with the size
+// and the modification time of the dat file, followed by a line of code, offset and length for each entry.
+const geoIndexSuffix = ".idx"
+
+// errNoGeoIndex means the file cannot be indexed, like a file read from the asset source, and should be read as a whole.
+var errNoGeoIndex = errors.New("no geo index")
+
+func geoIndexHeader(info os.FileInfo) string {
+	return fmt.Sprint(info.Size(), " ", info.ModTime().UnixNano())
+}
+
+// geoIndexReader tracks the offset of a buffered dat file.
+type geoIndexReader struct {
+	reader *bufio.Reader
+	offset int64
+}
+
+func (r *geoIndexReader) ReadByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err == nil {
+		r.offset++
+	}
+	return b, err
+}
+
+func (r *geoIndexReader) discard(n uint64) error {
+	discarded, err := r.reader.Discard(int(n))
+	r.offset += int64(discarded)
+	return err
+}
+
+// writeGeoIndex scans the dat file at path without decoding the entries and writes its index next to it.
+func writeGeoIndex(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(info.Size())
+
+	builder := new(strings.Builder)
+	builder.WriteString(geoIndexHeader(info))
+	builder.WriteByte('\n')
+	reader := &geoIndexReader{reader: bufio.NewReaderSize(file, 64*1024)}
+	for {
+		tag, err := binary.ReadUvarint(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return newError("malformed geo data").Base(err)
+		}
+		if protowire.Type(tag&7) != protowire.BytesType {
+			return newError("malformed geo data: unexpected wire type ", tag&7)
+		}
+		length, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return newError("malformed geo data").Base(err)
+		}
+		if length > size-uint64(reader.offset) {
+			return newError("malformed geo data: entry out of range")
+		}
+		offset := reader.offset
+		if protowire.Number(tag>>3) != 1 {
+			if err = reader.discard(length); err != nil {
+				return err
+			}
+			continue
+		}
+		// the code comes first in entries written by protobuf, so the head of the entry is usually enough
+		head, _ := reader.reader.Peek(int(min(length, 4096)))
+		code, err := geoEntryCode(head)
+		if err != nil || code == "" && length > uint64(len(head)) {
+			entry := make([]byte, length)
+			if _, err = io.ReadFull(reader.reader, entry); err != nil {
+				return err
+			}
+			reader.offset += int64(length)
+			if code, err = geoEntryCode(entry); err != nil {
+				return err
+			}
+		} else if err = reader.discard(length); err != nil {
+			return err
+		}
+		if code == "" || strings.ContainsAny(code, " \t\r\n") {
+			return newError("unsupported geo code: ", strconv.Quote(code))
+		}
+		builder.WriteString(fmt.Sprint(code, " ", offset, " ", length, "\n"))
+	}
+
+	dir, name := filepath.Split(path)
+	index, err := os.CreateTemp(dir, name+geoIndexSuffix+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(index, builder.String())
+	if closeErr := index.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(index.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(index.Name(), path+geoIndexSuffix)
+	}
+	if err != nil {
+		_ = os.Remove(index.Name())
+	}
+	return err
+}
+
+// readGeoIndex calls f with each line of the index of the dat file until it returns false.
+// errNoGeoIndex is returned if the index is missing or outdated.
+func readGeoIndex(path string, info os.FileInfo, f func(code string, offset int64, length int64) bool) error {
+	index, err := os.Open(path + geoIndexSuffix)
+	if err != nil {
+		return errNoGeoIndex
+	}
+	defer index.Close()
+	scanner := bufio.NewScanner(index)
+	if !scanner.Scan() || scanner.Text() != geoIndexHeader(info) {
+		return errNoGeoIndex
+	}
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			return errNoGeoIndex
+		}
+		offset, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return errNoGeoIndex
+		}
+		length, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil || offset+length > info.Size() {
+			return errNoGeoIndex
+		}
+		if !f(fields[0], offset, length) {
+			return nil
+		}
+	}
+	if scanner.Err() != nil {
+		return errNoGeoIndex
+	}
+	return nil
+}
+
+// openIndexedGeoFile opens a dat file through the file hook and makes sure its index is up to date.
+func openIndexedGeoFile(fileName string) (*os.File, os.FileInfo, error) {
+	seeker, err := filesystem.NewFileSeeker(platform.GetAssetLocation(fileName))
+	if err != nil {
+		return nil, nil, newError("failed to open ", fileName).Base(err)
+	}
+	file, ok := seeker.(*os.File)
+	if ok {
+		// files opened from the asset source are not indexed next to them
+		dir, _ := filepath.Split(file.Name())
+		ok = dir == internalAssetsPath || dir == externalAssetsPath
+	}
+	if !ok {
+		_ = seeker.Close()
+		return nil, nil, errNoGeoIndex
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, err
+	}
+	if readGeoIndex(file.Name(), info, func(string, int64, int64) bool { return false }) != nil {
+		if err = writeGeoIndex(file.Name()); err != nil {
+			logrus.Warn(newError("failed to index ", fileName).Base(err))
+			_ = file.Close()
+			return nil, nil, errNoGeoIndex
+		}
+	}
+	return file, info, nil
+}
+
+// readIndexedGeoEntry reads only the raw entry of a category, matched case-insensitively.
+func readIndexedGeoEntry(fileName string, category string) ([]byte, error) {
+	file, info, err := openIndexedGeoFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	offset, length := int64(-1), int64(0)
+	err = readGeoIndex(file.Name(), info, func(code string, entryOffset int64, entryLength int64) bool {
+		if strings.EqualFold(code, category) {
+			offset, length = entryOffset, entryLength
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 {
+		return nil, newError("category ", category, " not found in ", fileName)
+	}
+	entry := make([]byte, length)
+	if _, err = file.ReadAt(entry, offset); err != nil {
+		return nil, newError("failed to read ", fileName).Base(err)
+	}
+	return entry, nil
+}
+
+// listGeoFileCategories lists the codes of a dat file in file order, from its index if possible.
+func listGeoFileCategories(fileName string) ([]string, error) {
+	file, info, err := openIndexedGeoFile(fileName)
+	if err == nil {
+		defer file.Close()
+		var categories []string
+		err = readGeoIndex(file.Name(), info, func(code string, _ int64, _ int64) bool {
+			categories = append(categories, code)
+			return true
+		})
+		if err == nil {
+			return categories, nil
+		}
+	}
+	if err != errNoGeoIndex {
+		return nil, err
+	}
+	content, err := readGeoFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return readGeoCategories(content)
+}
+
+// indexedGeoLoader decodes only the referenced categories through the index, and falls back to
+// the memconservative decoder of v2ray for files without an index.
+type indexedGeoLoader struct {
+	access sync.Mutex
+	sites  map[string]*routercommon.GeoSite
+	ips    map[string]*routercommon.GeoIP
+}
+
+func newIndexedGeoLoader() geodata.LoaderImplementation {
+	return &indexedGeoLoader{
+		sites: make(map[string]*routercommon.GeoSite),
+		ips:   make(map[string]*routercommon.GeoIP),
+	}
+}
+
+func (l *indexedGeoLoader) LoadSite(filename, list string) ([]*routercommon.Domain, error) {
+	key := strings.ToLower(filename + ":" + list)
+	l.access.Lock()
+	defer l.access.Unlock()
+	if site, ok := l.sites[key]; ok {
+		return site.Domain, nil
+	}
+	site := new(routercommon.GeoSite)
+	entry, err := readIndexedGeoEntry(filename, list)
+	if err == errNoGeoIndex {
+		site, err = memconservative.GeoSiteCache(nil).Unmarshal(filename, list)
+	} else if err == nil {
+		err = proto.Unmarshal(entry, site)
+	}
+	if err != nil {
+		return nil, newError("failed to load ", list, " from ", filename).Base(err)
+	}
+	l.sites[key] = site
+	return site.Domain, nil
+}
+
+func (l *indexedGeoLoader) LoadIP(filename, country string) ([]*routercommon.CIDR, error) {
+	key := strings.ToLower(filename + ":" + country)
+	l.access.Lock()
+	defer l.access.Unlock()
+	if ip, ok := l.ips[key]; ok {
+		return ip.Cidr, nil
+	}
+	ip := new(routercommon.GeoIP)
+	entry, err := readIndexedGeoEntry(filename, country)
+	if err == errNoGeoIndex {
+		ip, err = memconservative.GeoIPCache(nil).Unmarshal(filename, country)
+	} else if err == nil {
+		err = proto.Unmarshal(entry, ip)
+	}
+	if err != nil {
+		return nil, newError("failed to load ", country, " from ", filename).Base(err)
+	}
+	l.ips[key] = ip
+	return ip.Cidr, nil
+}
+
+// geoLoaderFlag selects the geo loader of configs, which is memconservative if unset.
+const geoLoaderFlag = "v2ray.conf.geoloader"
+
+// selectIndexedGeoLoader makes configs use the index unless another loader is selected.
+func selectIndexedGeoLoader() {
+	if platform.NewEnvFlag(geoLoaderFlag).GetValue(func() string { return "" }) == "" {
+		_ = os.Setenv(geoLoaderFlag, "indexed")
+	}
+}
+
+func init() {
+	geodata.RegisterGeoDataLoaderImplementationCreator("indexed", newIndexedGeoLoader)
+}
@@ -0,0 +1,220 @@
+package libcore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+	"github.com/v2fly/v2ray-core/v5/infra/conf/geodata"
+)
+
+// initializeTestAssets uses a temporary directory for both internal and external assets without extracting.
+func initializeTestAssets(t testing.TB) string {
+	dir := t.TempDir() + string(filepath.Separator)
+	t.Setenv("v2ray.location.asset", dir)
+	verifiedAssets.Range(func(key, _ interface{}) bool {
+		verifiedAssets.Delete(key)
+		return true
+	})
+	if err := InitializeV2Ray(dir, dir, "", nil, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// writeTestGeoSite writes a geosite file of categories with domains of each and returns the entries.
+func writeTestGeoSite(t testing.TB, path string, categories int, domains int) []*routercommon.GeoSite {
+	list := new(routercommon.GeoSiteList)
+	for i := 0; i < categories; i++ {
+		site := &routercommon.GeoSite{CountryCode: fmt.Sprint("CATEGORY-", i)}
+		for j := 0; j < domains; j++ {
+			site.Domain = append(site.Domain, &routercommon.Domain{
+				Type:  routercommon.Domain_RootDomain,
+				Value: fmt.Sprint("domain-", j, ".category-", i, ".example.com"),
+			})
+		}
+		list.Entry = append(list.Entry, site)
+	}
+	content, err := proto.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return list.Entry
+}
+
+func TestGeoIndexRoundTrip(t *testing.T) {
+	dir := initializeTestAssets(t)
+	sites := writeTestGeoSite(t, dir+geositeDat, 16, 8)
+	if err := writeGeoIndex(dir + geositeDat); err != nil {
+		t.Fatal(err)
+	}
+	for _, site := range sites {
+		entry, err := readIndexedGeoEntry(geositeDat, site.CountryCode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := new(routercommon.GeoSite)
+		if err = proto.Unmarshal(entry, decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(decoded, site) {
+			t.Errorf("%s: got %v", site.CountryCode, decoded)
+		}
+	}
+	if _, err := readIndexedGeoEntry(geositeDat, "category-3"); err != nil {
+		t.Error("category is not matched case-insensitively: ", err)
+	}
+	if _, err := readIndexedGeoEntry(geositeDat, "missing"); err == nil {
+		t.Error("missing category found")
+	}
+	categories, err := listGeoFileCategories(geositeDat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(categories) != len(sites) || categories[0] != sites[0].CountryCode || categories[len(sites)-1] != sites[len(sites)-1].CountryCode {
+		t.Errorf("got categories %v", categories)
+	}
+}
+
+func TestGeoIndexStale(t *testing.T) {
+	dir := initializeTestAssets(t)
+	path := dir + geositeDat
+	writeTestGeoSite(t, path, 4, 4)
+	if err := writeGeoIndex(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// a different size
+	sites := writeTestGeoSite(t, path, 8, 2)
+	if err := os.Chtimes(path, time.Now(), time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	categories, err := listGeoFileCategories(geositeDat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(categories) != len(sites) {
+		t.Errorf("size change: got %d categories, want %d", len(categories), len(sites))
+	}
+
+	// the same size with a different modification time
+	sites = writeTestGeoSite(t, path, 8, 2)
+	sites[0].Domain[0].Value = "changed" + sites[0].Domain[0].Value[len("changed"):]
+	content, err := proto.Marshal(&routercommon.GeoSiteList{Entry: sites})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Hour)
+	if err = os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := readIndexedGeoEntry(geositeDat, sites[0].CountryCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(routercommon.GeoSite)
+	if err = proto.Unmarshal(entry, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(decoded, sites[0]) {
+		t.Errorf("modification time change: got %v", decoded)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = readGeoIndex(path, info, func(string, int64, int64) bool { return false }); err != nil {
+		t.Error("index is not rebuilt: ", err)
+	}
+}
+
+func benchmarkGeoSite(b *testing.B, load func(category string) error) {
+	dir := initializeTestAssets(b)
+	writeTestGeoSite(b, dir+geositeDat, 500, 200)
+	if err := writeGeoIndex(dir + geositeDat); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := load(fmt.Sprint("CATEGORY-", i%500)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkIndexedGeoSite(b *testing.B) {
+	benchmarkGeoSite(b, func(category string) error {
+		_, err := newIndexedGeoLoader().LoadSite(geositeDat, category)
+		return err
+	})
+}
+
+func BenchmarkStandardGeoSite(b *testing.B) {
+	loader, err := geodata.GetGeoDataLoader("standard")
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkGeoSite(b, func(category string) error {
+		_, err := loader.LoadGeoSiteWithAttr(geositeDat, category)
+		return err
+	})
+}
+
+func TestSelectIndexedGeoLoader(t *testing.T) {
+	t.Setenv(geoLoaderFlag, "standard")
+	initializeTestAssets(t)
+	if loader := os.Getenv(geoLoaderFlag); loader != "standard" {
+		t.Errorf("selected loader replaced by %s", loader)
+	}
+	os.Unsetenv(geoLoaderFlag)
+	initializeTestAssets(t)
+	if loader := os.Getenv(geoLoaderFlag); loader != "indexed" {
+		t.Errorf("got loader %q", loader)
+	}
+}
+
+func TestLookupGeoSiteIndexed(t *testing.T) {
+	dir := initializeTestAssets(t)
+	list := &routercommon.GeoSiteList{Entry: []*routercommon.GeoSite{
+		{CountryCode: "ADS", Domain: []*routercommon.Domain{{Type: routercommon.Domain_Regex, Value: `^ads\d+\.`}}},
+		{CountryCode: "FULL", Domain: []*routercommon.Domain{{Type: routercommon.Domain_Full, Value: "example.org"}}},
+		{CountryCode: "TRACK", Domain: []*routercommon.Domain{{Type: routercommon.Domain_Plain, Value: "track"}}},
+	}}
+	content, err := proto.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(dir+geositeDat, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for domain, want := range map[string]string{
+		"ads1.tracker.net": "ads\ntrack",
+		"Example.org.":     "full",
+		"www.example.org":  "",
+	} {
+		categories, err := LookupGeoSite(geositeDat, domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if categories != want {
+			t.Errorf("%s: got %q, want %q", domain, categories, want)
+		}
+	}
+	if _, err = os.Stat(dir + geositeDat + geoIndexSuffix); err != nil {
+		t.Error("geosite is not indexed by the lookup: ", err)
+	}
+	if _, ok := geoSiteRegexps.Load(`^ads\d+\.`); !ok {
+		t.Error("regexp is not cached")
+	}
+}
@@ -0,0 +1,236 @@
+package libcore
+
+import (
+	"io"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/v2fly/v2ray-core/v5/app/router/routercommon"
+	"github.com/v2fly/v2ray-core/v5/common/platform"
+	"github.com/v2fly/v2ray-core/v5/common/platform/filesystem"
+)
+
+// readGeoFile reads a dat file through the file hook installed by InitializeV2Ray.
+func readGeoFile(fileName string) ([]byte, error) {
+	file, err := filesystem.NewFileSeeker(platform.GetAssetLocation(fileName))
+	if err != nil {
+		return nil, newError("failed to open ", fileName).Base(err)
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// findGeoEntry returns the raw entry of a category, matched case-insensitively.
+func findGeoEntry(fileName string, category string) ([]byte, error) {
+	if entry, err := readIndexedGeoEntry(fileName, category); err != errNoGeoIndex {
+		return entry, err
+	}
+	content, err := readGeoFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var found []byte
+	err = forEachGeoEntry(content, func(code string, entry []byte) bool {
+		if strings.EqualFold(code, category) {
+			found = entry
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, newError("category ", category, " not found in ", fileName)
+	}
+	return found, nil
+}
+
+// ListGeoCategories returns the lower cased categories of a geosite or geoip file like geosite.dat, separated by newlines.
+func ListGeoCategories(fileName string) (string, error) {
+	categories, err := listGeoFileCategories(fileName)
+	if err != nil {
+		return "", err
+	}
+	for i, category := range categories {
+		categories[i] = strings.ToLower(category)
+	}
+	return strings.Join(categories, "\n"), nil
+}
+
+// CountGeoEntries returns the number of domain rules or CIDRs in a category.
+func CountGeoEntries(fileName string, category string) (int32, error) {
+	entry, err := findGeoEntry(fileName, category)
+	if err != nil {
+		return 0, err
+	}
+	count, err := countGeoEntryRules(entry)
+	return int32(count), err
+}
+
+// ListGeoSiteAttributes returns the sorted attributes used in a geosite category, like ads for geosite:category@ads,
+// separated by newlines.
+func ListGeoSiteAttributes(fileName string, category string) (string, error) {
+	entry, err := findGeoEntry(fileName, category)
+	if err != nil {
+		return "", err
+	}
+	var site routercommon.GeoSite
+	if err = proto.Unmarshal(entry, &site); err != nil {
+		return "", newError("failed to decode category ", category).Base(err)
+	}
+	seen := make(map[string]bool)
+	var attributes []string
+	for _, domain := range site.Domain {
+		for _, attribute := range domain.Attribute {
+			if !seen[attribute.Key] {
+				seen[attribute.Key] = true
+				attributes = append(attributes, attribute.Key)
+			}
+		}
+	}
+	sort.Strings(attributes)
+	return strings.Join(attributes, "\n"), nil
+}
+
+// forEachGeoFileEntry is forEachGeoEntry on a dat file, reading one entry at a time through its index if possible.
+func forEachGeoFileEntry(fileName string, f func(code string, entry []byte) bool) error {
+	file, info, err := openIndexedGeoFile(fileName)
+	if err == nil {
+		defer file.Close()
+		called := false
+		var readErr error
+		err = readGeoIndex(file.Name(), info, func(code string, offset int64, length int64) bool {
+			called = true
+			entry := make([]byte, length)
+			if _, readErr = file.ReadAt(entry, offset); readErr != nil {
+				return false
+			}
+			return f(code, entry)
+		})
+		if readErr != nil {
+			return newError("failed to read ", fileName).Base(readErr)
+		}
+		if err == nil {
+			return nil
+		}
+		if called {
+			return newError("malformed index of ", fileName)
+		}
+	}
+	if err != errNoGeoIndex {
+		return err
+	}
+	content, err := readGeoFile(fileName)
+	if err != nil {
+		return err
+	}
+	return forEachGeoEntry(content, f)
+}
+
+// geoSiteRegexps caches the compiled regexp rules of geosite files by pattern, nil if invalid.
+var geoSiteRegexps sync.Map
+
+func geoSiteRegexp(pattern string) *regexp.Regexp {
+	if matcher, ok := geoSiteRegexps.Load(pattern); ok {
+		return matcher.(*regexp.Regexp)
+	}
+	matcher, err := regexp.Compile(pattern)
+	if err != nil {
+		matcher = nil
+	}
+	geoSiteRegexps.Store(pattern, matcher)
+	return matcher
+}
+
+func matchGeoSiteDomain(rule *routercommon.Domain, domain string) bool {
+	value := strings.ToLower(rule.Value)
+	switch rule.Type {
+	case routercommon.Domain_Plain:
+		return strings.Contains(domain, value)
+	case routercommon.Domain_Regex:
+		matcher := geoSiteRegexp(rule.Value)
+		return matcher != nil && matcher.MatchString(domain)
+	case routercommon.Domain_RootDomain:
+		return domain == value || strings.HasSuffix(domain, "."+value)
+	case routercommon.Domain_Full:
+		return domain == value
+	}
+	return false
+}
+
+// LookupGeoSite returns the lower cased categories of a geosite file with a rule matching the domain, separated by newlines.
+func LookupGeoSite(fileName string, domain string) (string, error) {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if domain == "" {
+		return "", newError("empty domain")
+	}
+	var categories []string
+	var decodeErr error
+	err := forEachGeoFileEntry(fileName, func(code string, entry []byte) bool {
+		var site routercommon.GeoSite
+		if err := proto.Unmarshal(entry, &site); err != nil {
+			decodeErr = newError("failed to decode category ", code).Base(err)
+			return false
+		}
+		for _, rule := range site.Domain {
+			if matchGeoSiteDomain(rule, domain) {
+				categories = append(categories, strings.ToLower(code))
+				break
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = decodeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(categories, "\n"), nil
+}
+
+// LookupGeoIP returns the lower cased categories of a geoip file containing the IP, separated by newlines.
+// Categories with inverse match are not reported.
+func LookupGeoIP(fileName string, ip string) (string, error) {
+	address, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return "", newError("invalid ip address: ", ip).Base(err)
+	}
+	address = address.Unmap()
+	var categories []string
+	var decodeErr error
+	err = forEachGeoFileEntry(fileName, func(code string, entry []byte) bool {
+		var geoip routercommon.GeoIP
+		if err := proto.Unmarshal(entry, &geoip); err != nil {
+			decodeErr = newError("failed to decode category ", code).Base(err)
+			return false
+		}
+		if geoip.InverseMatch {
+			return true
+		}
+		for _, cidr := range geoip.Cidr {
+			prefixAddress, ok := netip.AddrFromSlice(cidr.Ip)
+			if !ok {
+				continue
+			}
+			prefix, err := prefixAddress.Unmap().Prefix(int(cidr.Prefix))
+			if err == nil && prefix.Contains(address) {
+				categories = append(categories, strings.ToLower(code))
+				break
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = decodeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(categories, "\n"), nil
+}
@@ -0,0 +1,320 @@
+package libcore
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type geoAssetSource struct {
+	name         string
+	url          string
+	checksumURL  string
+	signatureURL string
+}
+
+// GeoAssetUpdater downloads geo files into the external assets directory.
+// All files are downloaded and verified before any is replaced, the replaced files are kept with the .bak suffix
+// and restored if a replacement or the reload of the instance fails.
+type GeoAssetUpdater struct {
+	client    HTTPClient
+	assets    []*geoAssetSource
+	publicKey ed25519.PublicKey
+	instance  *V2RayInstance
+	listener  DownloadListener
+}
+
+func NewGeoAssetUpdater(client HTTPClient) *GeoAssetUpdater {
+	return &GeoAssetUpdater{client: client}
+}
+
+// AddAsset adds a file like geosite.dat to update. The checksum URL points to a sha256sum file,
+// and the signature URL to an ed25519 signature of the file in raw, base64 or hex, at least one of them is required.
+func (u *GeoAssetUpdater) AddAsset(name string, url string, checksumURL string, signatureURL string) {
+	u.assets = append(u.assets, &geoAssetSource{
+		name:         name,
+		url:          url,
+		checksumURL:  checksumURL,
+		signatureURL: signatureURL,
+	})
+}
+
+// SetPublicKey sets the ed25519 public key in base64 or hex to verify signatures.
+func (u *GeoAssetUpdater) SetPublicKey(publicKey string) error {
+	key, err := decodeBinary(publicKey)
+	if err != nil {
+		return newError("invalid public key").Base(err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return newError("invalid public key length: ", len(key))
+	}
+	u.publicKey = key
+	return nil
+}
+
+// SetInstance sets the instance to reload after the files are replaced.
+func (u *GeoAssetUpdater) SetInstance(instance *V2RayInstance) {
+	u.instance = instance
+}
+
+func (u *GeoAssetUpdater) SetDownloadListener(listener DownloadListener) {
+	u.listener = listener
+}
+
+// decodeBinary decodes hex or standard base64.
+func decodeBinary(content string) ([]byte, error) {
+	content = strings.TrimSpace(content)
+	if data, err := hex.DecodeString(content); err == nil {
+		return data, nil
+	}
+	return base64.StdEncoding.DecodeString(content)
+}
+
+// parseChecksum finds the sum of a file in the output of sha256sum, a file containing only a sum is also accepted.
+func parseChecksum(content string, fileName string) (string, error) {
+	lines := strings.Split(strings.TrimSpace(content), "\n")
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		var sum string
+		switch {
+		case len(fields) == 1 && len(lines) == 1:
+			sum = fields[0]
+		case len(fields) >= 2 && strings.TrimPrefix(fields[1], "*") == fileName:
+			sum = fields[0]
+		default:
+			continue
+		}
+		if decoded, err := hex.DecodeString(sum); err != nil || len(decoded) != 32 {
+			return "", newError("invalid sha256 sum: ", sum)
+		}
+		return sum, nil
+	}
+	return "", newError("sha256 sum of ", fileName, " not found")
+}
+
+func (u *GeoAssetUpdater) fetch(link string) ([]byte, error) {
+	request := u.client.NewRequest()
+	if err := request.SetURL(link); err != nil {
+		return nil, err
+	}
+	response, err := request.Execute()
+	if err != nil {
+		return nil, err
+	}
+	return response.GetContent(), nil
+}
+
+// download saves the asset to stagingPath and verifies it.
+func (u *GeoAssetUpdater) download(asset *geoAssetSource, stagingPath string) error {
+	if asset.checksumURL == "" && asset.signatureURL == "" {
+		return newError("no checksum or signature to verify")
+	}
+	if asset.signatureURL != "" && u.publicKey == nil {
+		return newError("no public key to verify the signature")
+	}
+	var sum string
+	if asset.checksumURL != "" {
+		content, err := u.fetch(asset.checksumURL)
+		if err != nil {
+			return newError("failed to download checksum").Base(err)
+		}
+		fileName := asset.name
+		if link, err := url.Parse(asset.url); err == nil && path.Base(link.Path) != "/" && path.Base(link.Path) != "." {
+			fileName = path.Base(link.Path)
+		}
+		if sum, err = parseChecksum(string(content), fileName); err != nil {
+			return err
+		}
+	}
+
+	request := u.client.NewRequest()
+	if err := request.SetURL(asset.url); err != nil {
+		return err
+	}
+	if err := request.Download(stagingPath, sum, u.listener); err != nil {
+		return err
+	}
+	content, err := os.ReadFile(stagingPath)
+	if err != nil {
+		return err
+	}
+
+	if asset.signatureURL != "" {
+		signature, err := u.fetch(asset.signatureURL)
+		if err != nil {
+			return newError("failed to download signature").Base(err)
+		}
+		if len(signature) != ed25519.SignatureSize {
+			if signature, err = decodeBinary(string(signature)); err != nil {
+				return newError("invalid signature").Base(err)
+			}
+		}
+		if !ed25519.Verify(u.publicKey, content, signature) {
+			return newError("signature mismatch")
+		}
+	}
+
+	categories, err := readGeoCategories(content)
+	if err != nil {
+		return err
+	}
+	if len(categories) == 0 {
+		return newError("no categories found")
+	}
+	return nil
+}
+
+// geoAssetVersionName returns the version file compared by the extraction of bundled assets.
+func geoAssetVersionName(name string) string {
+	switch name {
+	case geoipDat:
+		return geoipVersion
+	case geositeDat:
+		return geositeVersion
+	}
+	return ""
+}
+
+// Update downloads and verifies all assets, then replaces them and reloads the instance if set.
+// The versions of geoip.dat and geosite.dat are set to the current time, so that they are not overwritten by older bundled ones.
+func (u *GeoAssetUpdater) Update() error {
+	dir := externalAssetsPath
+	if dir == "" {
+		return newError("assets are not initialized")
+	}
+	if len(u.assets) == 0 {
+		return newError("no assets to update")
+	}
+
+	var names []string
+	defer func() {
+		for _, name := range names {
+			_ = os.Remove(dir + name + ".new")
+		}
+	}()
+	version := time.Now().UTC().Format("200601021504")
+	for _, asset := range u.assets {
+		// the sum of the bundled file is removed first, updated files are verified on download instead
+		names = append(names, asset.name+assetChecksumSuffix, asset.name)
+		if err := u.download(asset, dir+asset.name+".new"); err != nil {
+			return newError("failed to update ", asset.name).Base(err)
+		}
+		if versionName := geoAssetVersionName(asset.name); versionName != "" {
+			names = append(names, versionName)
+			if err := os.WriteFile(dir+versionName+".new", []byte(version), 0o644); err != nil {
+				return err
+			}
+		}
+	}
+
+	assetsAccess.Lock()
+	replaced, err := replaceAssets(dir, names)
+	if err != nil {
+		restoreAssets(dir, replaced)
+		assetsAccess.Unlock()
+		return newError("failed to replace assets").Base(err)
+	}
+	u.resetVerified()
+	for _, asset := range u.assets {
+		if err = writeGeoIndex(dir + asset.name); err != nil {
+			logrus.Warn(newError("failed to index ", asset.name).Base(err))
+		}
+	}
+	assetsAccess.Unlock()
+
+	wasStarted := u.instance != nil && u.instance.started
+	if err = u.reload(); err != nil {
+		assetsAccess.Lock()
+		restoreAssets(dir, replaced)
+		assetsAccess.Unlock()
+		u.resetVerified()
+		if wasStarted && !u.instance.started {
+			// the new core failed to start, start again with the restored assets
+			if reloadErr := u.instance.Reload(); reloadErr == nil {
+				_ = u.instance.Start()
+			}
+		}
+		return newError("failed to reload with the updated assets, rolled back").Base(err)
+	}
+	return nil
+}
+
+// Rollback restores the files replaced by the last update and reloads the instance if set.
+func (u *GeoAssetUpdater) Rollback() error {
+	dir := externalAssetsPath
+	if dir == "" {
+		return newError("assets are not initialized")
+	}
+	var names []string
+	for _, asset := range u.assets {
+		names = append(names, asset.name+assetChecksumSuffix, asset.name)
+		if versionName := geoAssetVersionName(asset.name); versionName != "" {
+			names = append(names, versionName)
+		}
+	}
+	assetsAccess.Lock()
+	err := restoreAssets(dir, names)
+	assetsAccess.Unlock()
+	u.resetVerified()
+	if err != nil {
+		return err
+	}
+	return u.reload()
+}
+
+// resetVerified makes the replaced or restored files verified again on the next open.
+func (u *GeoAssetUpdater) resetVerified() {
+	for _, asset := range u.assets {
+		verifiedAssets.Delete(externalAssetsPath + asset.name)
+	}
+}
+
+func (u *GeoAssetUpdater) reload() error {
+	if u.instance == nil || u.instance.core == nil {
+		return nil
+	}
+	return u.instance.Reload()
+}
+
+// replaceAssets moves each name to name.bak if it exists and name.new to name, returning the names replaced.
+// A name without name.new is removed, leaving only the backup.
+func replaceAssets(dir string, names []string) ([]string, error) {
+	var replaced []string
+	for _, name := range names {
+		file := dir + name
+		if err := os.Rename(file, file+".bak"); os.IsNotExist(err) {
+			// drop the backup of an earlier update
+			_ = os.Remove(file + ".bak")
+		} else if err != nil {
+			return replaced, err
+		}
+		if err := os.Rename(file+".new", file); err != nil && !os.IsNotExist(err) {
+			_ = os.Rename(file+".bak", file)
+			return replaced, err
+		}
+		replaced = append(replaced, name)
+	}
+	return replaced, nil
+}
+
+// restoreAssets moves name.bak back to name, names without backups are left as is.
+func restoreAssets(dir string, names []string) error {
+	var lastErr error
+	for _, name := range names {
+		file := dir + name
+		if _, err := os.Stat(file + ".bak"); err != nil {
+			continue
+		}
+		if err := os.Rename(file+".bak", file); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
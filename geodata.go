@@ -0,0 +1,92 @@
+package libcore
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// forEachGeoEntry calls f with the code and the raw message of each entry of a geoip.dat or geosite.dat file.
+// Both are a list of entries in field 1 with the code in field 1 of the entry, so the rules are not decoded.
+func forEachGeoEntry(content []byte, f func(code string, entry []byte) bool) error {
+	for len(content) > 0 {
+		number, wireType, n := protowire.ConsumeTag(content)
+		if n < 0 {
+			return newError("malformed geo data").Base(protowire.ParseError(n))
+		}
+		content = content[n:]
+		if number != 1 || wireType != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(number, wireType, content)
+			if n < 0 {
+				return newError("malformed geo data").Base(protowire.ParseError(n))
+			}
+			content = content[n:]
+			continue
+		}
+		entry, n := protowire.ConsumeBytes(content)
+		if n < 0 {
+			return newError("malformed geo data").Base(protowire.ParseError(n))
+		}
+		content = content[n:]
+		code, err := geoEntryCode(entry)
+		if err != nil {
+			return err
+		}
+		if !f(code, entry) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func geoEntryCode(entry []byte) (string, error) {
+	for len(entry) > 0 {
+		number, wireType, n := protowire.ConsumeTag(entry)
+		if n < 0 {
+			return "", newError("malformed geo entry").Base(protowire.ParseError(n))
+		}
+		entry = entry[n:]
+		if number == 1 && wireType == protowire.BytesType {
+			code, n := protowire.ConsumeString(entry)
+			if n < 0 {
+				return "", newError("malformed geo entry").Base(protowire.ParseError(n))
+			}
+			return code, nil
+		}
+		n = protowire.ConsumeFieldValue(number, wireType, entry)
+		if n < 0 {
+			return "", newError("malformed geo entry").Base(protowire.ParseError(n))
+		}
+		entry = entry[n:]
+	}
+	return "", nil
+}
+
+// countGeoEntryRules counts the domains of a geosite entry or the CIDRs of a geoip entry, both in field 2.
+func countGeoEntryRules(entry []byte) (int, error) {
+	var count int
+	for len(entry) > 0 {
+		number, wireType, n := protowire.ConsumeTag(entry)
+		if n < 0 {
+			return 0, newError("malformed geo entry").Base(protowire.ParseError(n))
+		}
+		entry = entry[n:]
+		if number == 2 {
+			count++
+		}
+		n = protowire.ConsumeFieldValue(number, wireType, entry)
+		if n < 0 {
+			return 0, newError("malformed geo entry").Base(protowire.ParseError(n))
+		}
+		entry = entry[n:]
+	}
+	return count, nil
+}
+
+// readGeoCategories lists the codes of a geoip.dat or geosite.dat file in file order.
+func readGeoCategories(content []byte) ([]string, error) {
+	var categories []string
+	err := forEachGeoEntry(content, func(code string, _ []byte) bool {
+		categories = append(categories, code)
+		return true
+	})
+	return categories, err
+}
@@ -3,6 +3,7 @@ package libcore
 import (
 	"bytes"
 	"context"
+	"crypto"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
@@ -14,21 +15,52 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/quic-go/quic-go/http3"
+	"github.com/sirupsen/logrus"
 	"github.com/v2fly/v2ray-core/v5/common/buf"
 	"github.com/wzshiming/socks5"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 type HTTPClient interface {
 	RestrictedTLS()
 	ModernTLS()
 	PinnedTLS12()
+	// PinnedSHA256 adds a pin of the hex sha256 sum of any certificate in the chain. Each call adds to the pins
+	// instead of replacing the previous one, pins of both kinds are kept together and the chain is accepted
+	// if any of them matches. Separators like in AB:CD are ignored.
 	PinnedSHA256(sumHex string)
+	// PinnedSPKISHA256 adds a pin of the hex sha256 sum of the SubjectPublicKeyInfo of any certificate in the chain,
+	// in the same way as PinnedSHA256.
+	PinnedSPKISHA256(sumHex string)
+	SetClientCertificate(certPEM []byte, keyPEM []byte) error
+	SetClientCertificatePKCS12(data []byte, password string) error
+	// AddRootCertificates trusts certificates in the PEM in addition to the system roots.
+	AddRootCertificates(certPEM []byte) error
+	// SetServerName overrides the SNI and the name the certificate is verified against.
+	SetServerName(serverName string)
 	TrySocks5(port int32)
 	UseSocks5(port int32)
+	UseInstance(instance *V2RayInstance, outboundTag string)
 	KeepAlive()
+	// UseHTTP3 sends requests over HTTP/3 only.
+	UseHTTP3()
+	// UseDoH resolves domains with the DNS over HTTPS server, dialed as the other connections.
+	// serverIP is the address of the server, it can be empty only if the host of the URL is an IP address.
+	UseDoH(serverURL string, serverIP string) error
+	// UseDoT resolves domains with the DNS over TLS server (host:port), dialed as the other connections at serverIP like UseDoH.
+	UseDoT(server string, serverIP string) error
+	// UseInstanceDNS resolves domains with the dns client of a running instance, lookups fail until it is loaded.
+	UseInstanceDNS(instance *V2RayInstance)
+	UseLocalResolver(resolver LocalResolver)
+	// SetCacheDir enables conditional GET requests with ETag and Last-Modified, responses are cached in dir by URL.
+	SetCacheDir(dir string)
 	NewRequest() HTTPRequest
 	Close()
 }
@@ -40,14 +72,36 @@ type HTTPRequest interface {
 	SetContent(content []byte)
 	SetContentString(content string)
 	SetUserAgent(userAgent string)
+	// AcceptAnyStatus makes Execute return responses of any status instead of failing on non 2xx and 304 ones.
+	AcceptAnyStatus()
+	// SetMaxRedirects limits followed redirects, the last redirect response is returned by Execute
+	// as a successful response when exceeded.
+	SetMaxRedirects(maxRedirects int32)
+	SetSameHostRedirectOnly(sameHost bool)
+	// SetTimeout sets the timeout of the whole request in milliseconds, including reading the body.
+	SetTimeout(timeout int32)
+	Cancel()
 	Execute() (HTTPResponse, error)
+	Download(path string, sha256Hex string, listener DownloadListener) error
 }
 
 type HTTPResponse interface {
+	GetStatusCode() int32
+	GetStatus() string
 	GetContent() []byte
 	GetContentString() string
 	GetHeader(key string) string
+	// GetHeaderNames returns canonical header names separated by newlines.
+	GetHeaderNames() string
+	// GetHeaderValues returns all values of the header separated by newlines.
+	GetHeaderValues(key string) string
+	// GetURL returns the final URL after redirects.
+	GetURL() string
+	// GetRedirectChain returns the URLs of followed redirects separated by newlines, starting with the requested one.
+	GetRedirectChain() string
 	WriteTo(path string) error
+	// IsNotModified returns true if the server responded 304 and the content is loaded from the cache.
+	IsNotModified() bool
 }
 
 var (
@@ -60,6 +114,14 @@ type httpClient struct {
 	tls       tls.Config
 	client    http.Client
 	transport http.Transport
+	cacheDir  string
+
+	pinnedSums     []string
+	pinnedSPKISums []string
+
+	dialer   *outboundDialer
+	resolver httpResolver
+	http3    *http3.Transport
 }
 
 func NewHttpClient() HTTPClient {
@@ -67,6 +129,8 @@ func NewHttpClient() HTTPClient {
 	client.client.Transport = &client.transport
 	client.transport.TLSClientConfig = &client.tls
 	client.transport.DisableKeepAlives = true
+	client.transport.DialContext = client.dialContext
+	client.dialer = newOutboundDialer(false, 0)
 	return client
 }
 
@@ -89,23 +153,99 @@ func (c *httpClient) PinnedTLS12() {
 	c.tls.MaxVersion = tls.VersionTLS12
 }
 
+// normalizePin lower cases a hex sum and removes the separators of formats like AB:CD.
+func normalizePin(sumHex string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(strings.TrimSpace(sumHex)))
+}
+
 func (c *httpClient) PinnedSHA256(sumHex string) {
-	c.tls.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-		for _, rawCert := range rawCerts {
-			certSum := sha256.Sum256(rawCert)
-			if sumHex == hex.EncodeToString(certSum[:]) {
-				return nil
-			}
+	c.pinnedSums = append(c.pinnedSums, normalizePin(sumHex))
+	c.tls.VerifyPeerCertificate = c.verifyPins
+}
+
+func (c *httpClient) PinnedSPKISHA256(sumHex string) {
+	c.pinnedSPKISums = append(c.pinnedSPKISums, normalizePin(sumHex))
+	c.tls.VerifyPeerCertificate = c.verifyPins
+}
+
+// verifyPins accepts the chain if any certificate matches any of the certificate or SPKI pins.
+func (c *httpClient) verifyPins(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	for _, rawCert := range rawCerts {
+		certSum := sha256.Sum256(rawCert)
+		if Contains(c.pinnedSums, hex.EncodeToString(certSum[:])) {
+			return nil
+		}
+		if len(c.pinnedSPKISums) == 0 {
+			continue
+		}
+		cert, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return err
 		}
-		return newError("pinned sha256 sum mismatch")
+		spkiSum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		if Contains(c.pinnedSPKISums, hex.EncodeToString(spkiSum[:])) {
+			return nil
+		}
+	}
+	return newError("pinned sha256 sum mismatch")
+}
+
+func (c *httpClient) SetClientCertificate(certPEM []byte, keyPEM []byte) error {
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return newError("failed to load client certificate").Base(err)
 	}
+	c.tls.Certificates = []tls.Certificate{certificate}
+	return nil
+}
+
+func (c *httpClient) SetClientCertificatePKCS12(data []byte, password string) error {
+	privateKey, leaf, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return newError("failed to decode pkcs12").Base(err)
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return newError("unsupported private key type ", fmt.Sprintf("%T", privateKey))
+	}
+	if publicKey, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !publicKey.Equal(leaf.PublicKey) {
+		return newError("private key does not match the certificate")
+	}
+	certificate := tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  privateKey,
+		Leaf:        leaf,
+	}
+	for _, cert := range chain {
+		certificate.Certificate = append(certificate.Certificate, cert.Raw)
+	}
+	c.tls.Certificates = []tls.Certificate{certificate}
+	return nil
+}
+
+func (c *httpClient) AddRootCertificates(certPEM []byte) error {
+	if c.tls.RootCAs == nil {
+		roots, err := x509.SystemCertPool()
+		if err != nil || roots == nil {
+			roots = x509.NewCertPool()
+		}
+		c.tls.RootCAs = roots
+	}
+	if !c.tls.RootCAs.AppendCertsFromPEM(certPEM) {
+		return newError("no certificate found in pem")
+	}
+	return nil
+}
+
+func (c *httpClient) SetServerName(serverName string) {
+	c.tls.ServerName = serverName
 }
 
 // not used
 func (c *httpClient) TrySocks5(port int32) {
 	dialer := new(net.Dialer)
 	socks5Dialer, _ := socks5.NewDialer("socks5h://127.0.0.1:" + strconv.Itoa(int(port)))
-	c.transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+	c.dialer.dialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
 		for {
 			socksConn, err := socks5Dialer.DialContext(ctx, "tcp", addr)
 			if err != nil {
@@ -118,10 +258,11 @@ func (c *httpClient) TrySocks5(port int32) {
 }
 
 func (c *httpClient) UseSocks5(port int32) {
-	c.transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-		dialer, _ := socks5.NewDialer("socks5h://127.0.0.1:" + strconv.Itoa(int(port)))
-		return dialer.DialContext(ctx, network, addr)
-	}
+	c.dialer = newOutboundDialer(true, int(port))
+}
+
+func (c *httpClient) UseInstance(instance *V2RayInstance, outboundTag string) {
+	c.dialer = newInstanceDialer(instance, outboundTag)
 }
 
 func (c *httpClient) KeepAlive() {
@@ -130,21 +271,35 @@ func (c *httpClient) KeepAlive() {
 }
 
 func (c *httpClient) NewRequest() HTTPRequest {
-	req := &httpRequest{httpClient: c}
+	req := &httpRequest{httpClient: c, maxRedirects: -1}
 	req.request = http.Request{
 		Method: "GET",
 		Header: http.Header{},
 	}
+	req.ctx, req.cancel = context.WithCancel(context.Background())
 	return req
 }
 
 func (c *httpClient) Close() {
 	c.transport.CloseIdleConnections()
+	if c.http3 != nil {
+		_ = c.http3.Close()
+	}
 }
 
 type httpRequest struct {
 	*httpClient
 	request http.Request
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	acceptAnyStatus  bool
+	maxRedirects     int32
+	sameHostRedirect bool
+	timeout          time.Duration
+	// redirectLimited is set when the last request stopped at the redirect limit.
+	redirectLimited bool
 }
 
 func (r *httpRequest) SetURL(link string) (err error) {
@@ -175,7 +330,11 @@ func (r *httpRequest) SetUserAgent(userAgent string) {
 func (r *httpRequest) SetContent(content []byte) {
 	buffer := bytes.Buffer{}
 	buffer.Write(content)
-	r.request.Body = io.NopCloser(bytes.NewReader(buffer.Bytes()))
+	body := buffer.Bytes()
+	r.request.Body = io.NopCloser(bytes.NewReader(body))
+	r.request.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
 	r.request.ContentLength = int64(len(content))
 }
 
@@ -183,20 +342,106 @@ func (r *httpRequest) SetContentString(content string) {
 	r.SetContent([]byte(content))
 }
 
+func (r *httpRequest) AcceptAnyStatus() {
+	r.acceptAnyStatus = true
+}
+
+func (r *httpRequest) SetMaxRedirects(maxRedirects int32) {
+	r.maxRedirects = maxRedirects
+}
+
+func (r *httpRequest) SetSameHostRedirectOnly(sameHost bool) {
+	r.sameHostRedirect = sameHost
+}
+
+func (r *httpRequest) SetTimeout(timeout int32) {
+	r.timeout = time.Duration(timeout) * time.Millisecond
+}
+
+func (r *httpRequest) Cancel() {
+	r.cancel()
+}
+
+// do sends the request with the redirect policy and timeout of the request,
+// and returns the URLs of followed redirects.
+func (r *httpRequest) do() (*http.Response, []string, error) {
+	var redirects []string
+	client := r.client
+	client.Timeout = r.timeout
+	r.redirectLimited = false
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(redirects) == 0 {
+			redirects = append(redirects, via[0].URL.String())
+		}
+		if r.maxRedirects >= 0 && len(via) > int(r.maxRedirects) {
+			r.redirectLimited = true
+			return http.ErrUseLastResponse
+		}
+		if r.maxRedirects < 0 && len(via) >= 10 {
+			return newError("stopped after 10 redirects")
+		}
+		if r.sameHostRedirect && req.URL.Host != via[0].URL.Host {
+			return newError("redirect to another host: ", req.URL.Host)
+		}
+		redirects = append(redirects, req.URL.String())
+		return nil
+	}
+	response, err := client.Do(r.request.WithContext(r.ctx))
+	return response, redirects, err
+}
+
 func (r *httpRequest) Execute() (HTTPResponse, error) {
-	response, err := r.client.Do(&r.request)
+	if r.request.Header.Get("Accept-Encoding") == "" {
+		r.request.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	var cacheEntry *httpCacheEntry
+	var link string
+	if r.cacheDir != "" && r.request.Method == http.MethodGet {
+		link = r.request.URL.String()
+		cacheEntry = r.loadCache(link)
+		if cacheEntry != nil {
+			if cacheEntry.ETag != "" {
+				r.request.Header.Set("If-None-Match", cacheEntry.ETag)
+			}
+			if cacheEntry.LastModified != "" {
+				r.request.Header.Set("If-Modified-Since", cacheEntry.LastModified)
+			}
+		}
+	}
+	response, redirects, err := r.do()
 	if err != nil {
 		return nil, err
 	}
-	httpResp := &httpResponse{Response: response}
-	if response.StatusCode != http.StatusOK {
+	if response.StatusCode == http.StatusNotModified && cacheEntry != nil {
+		httpResp, err := r.cachedResponse(link, cacheEntry, response)
+		if err != nil {
+			return nil, err
+		}
+		httpResp.redirects = redirects
+		return httpResp, nil
+	}
+	if err = decodeResponse(response); err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+	httpResp := &httpResponse{Response: response, redirects: redirects}
+	success := response.StatusCode >= 200 && response.StatusCode < 300 || response.StatusCode == http.StatusNotModified ||
+		r.redirectLimited && response.StatusCode >= 300 && response.StatusCode < 400
+	if !success && !r.acceptAnyStatus {
 		return nil, errors.New(httpResp.errorString())
 	}
+	if link != "" && response.StatusCode == http.StatusOK {
+		if err = r.storeCache(link, httpResp); err != nil {
+			logrus.Warn(newError("failed to cache response of ", link).Base(err))
+		}
+	}
 	return httpResp, nil
 }
 
 type httpResponse struct {
 	*http.Response
+	notModified bool
+	redirects   []string
 
 	getContentOnce sync.Once
 	content        []byte
@@ -230,10 +475,46 @@ func (h *httpResponse) GetContentString() string {
 	return string(content)
 }
 
+func (h *httpResponse) GetStatusCode() int32 {
+	return int32(h.StatusCode)
+}
+
+func (h *httpResponse) GetStatus() string {
+	return h.Status
+}
+
 func (r *httpResponse) GetHeader(key string) string {
 	return r.Response.Header.Get(key)
 }
 
+func (h *httpResponse) GetHeaderNames() string {
+	names := make([]string, 0, len(h.Header))
+	for name := range h.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, "\n")
+}
+
+func (h *httpResponse) GetHeaderValues(key string) string {
+	return strings.Join(h.Header.Values(key), "\n")
+}
+
+func (h *httpResponse) GetURL() string {
+	if h.Request == nil || h.Request.URL == nil {
+		return ""
+	}
+	return h.Request.URL.String()
+}
+
+func (h *httpResponse) GetRedirectChain() string {
+	return strings.Join(h.redirects, "\n")
+}
+
+func (h *httpResponse) IsNotModified() bool {
+	return h.notModified
+}
+
 func (h *httpResponse) WriteTo(path string) error {
 	defer h.Body.Close()
 	file, err := os.Create(path)
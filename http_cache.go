@@ -0,0 +1,174 @@
+package libcore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"libcore/comm"
+)
+
+const acceptEncoding = "gzip, br, zstd"
+
+// decodedBody creates the decoder on the first read, so that an empty body is not decoded.
+type decodedBody struct {
+	body    io.ReadCloser
+	decode  func(body io.Reader) (io.Reader, interface{}, error)
+	reader  io.Reader
+	closer  interface{}
+	openErr error
+}
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	if b.reader == nil && b.openErr == nil {
+		b.reader, b.closer, b.openErr = b.decode(b.body)
+	}
+	if b.openErr != nil {
+		return 0, b.openErr
+	}
+	return b.reader.Read(p)
+}
+
+func (b *decodedBody) Close() error {
+	comm.CloseIgnore(b.closer, b.body)
+	return nil
+}
+
+// decodeResponse replaces the body of a response with Content-Encoding gzip, br or zstd by the decoded one.
+// Responses to HEAD and statuses without a body are left as is.
+func decodeResponse(response *http.Response) error {
+	if response.Request != nil && response.Request.Method == http.MethodHead ||
+		response.StatusCode < 200 || response.StatusCode == http.StatusNoContent || response.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	encoding := strings.ToLower(strings.TrimSpace(response.Header.Get("Content-Encoding")))
+	var decode func(body io.Reader) (io.Reader, interface{}, error)
+	switch encoding {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		decode = func(body io.Reader) (io.Reader, interface{}, error) {
+			gzipReader, err := gzip.NewReader(body)
+			if err == io.EOF {
+				return nil, nil, io.EOF
+			}
+			if err != nil {
+				return nil, nil, newError("failed to create gzip reader").Base(err)
+			}
+			return gzipReader, gzipReader, nil
+		}
+	case "br":
+		decode = func(body io.Reader) (io.Reader, interface{}, error) {
+			return brotli.NewReader(body), nil, nil
+		}
+	case "zstd":
+		decode = func(body io.Reader) (io.Reader, interface{}, error) {
+			zstdReader, err := zstd.NewReader(body)
+			if err != nil {
+				return nil, nil, newError("failed to create zstd reader").Base(err)
+			}
+			return zstdReader, comm.Closer(zstdReader.Close), nil
+		}
+	default:
+		return newError("unsupported content encoding: ", encoding)
+	}
+	response.Body = &decodedBody{body: response.Body, decode: decode}
+	response.Header.Del("Content-Encoding")
+	response.Header.Del("Content-Length")
+	response.ContentLength = -1
+	response.Uncompressed = true
+	return nil
+}
+
+type httpCacheEntry struct {
+	URL          string      `json:"url"`
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"last_modified,omitempty"`
+	Header       http.Header `json:"header"`
+}
+
+func (c *httpClient) SetCacheDir(dir string) {
+	c.cacheDir = dir
+}
+
+func (c *httpClient) cachePath(link string) string {
+	return filepath.Join(c.cacheDir, Sha256Hex([]byte(link)))
+}
+
+func (c *httpClient) loadCache(link string) *httpCacheEntry {
+	content, err := os.ReadFile(c.cachePath(link) + ".json")
+	if err != nil {
+		return nil
+	}
+	entry := new(httpCacheEntry)
+	if json.Unmarshal(content, entry) != nil || entry.URL != link {
+		return nil
+	}
+	if _, err = os.Stat(c.cachePath(link) + ".body"); err != nil {
+		return nil
+	}
+	return entry
+}
+
+func (c *httpClient) storeCache(link string, response *httpResponse) error {
+	etag := response.Header.Get("ETag")
+	lastModified := response.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return nil
+	}
+	content := response.GetContent()
+	if response.contentError != nil {
+		return response.contentError
+	}
+	metadata, err := json.Marshal(&httpCacheEntry{
+		URL:          link,
+		ETag:         etag,
+		LastModified: lastModified,
+		Header:       response.Header,
+	})
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(c.cacheDir, 0o755); err != nil {
+		return err
+	}
+	path := c.cachePath(link)
+	if err = writeFileAtomic(path+".body", content); err != nil {
+		return err
+	}
+	return writeFileAtomic(path+".json", metadata)
+}
+
+func writeFileAtomic(path string, content []byte) error {
+	if err := os.WriteFile(path+".tmp", content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// cachedResponse builds the response of a 304 from the cache, with headers of the 304 response taking precedence.
+func (c *httpClient) cachedResponse(link string, entry *httpCacheEntry, response *http.Response) (*httpResponse, error) {
+	content, err := os.ReadFile(c.cachePath(link) + ".body")
+	if err != nil {
+		return nil, err
+	}
+	header := entry.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	for key, values := range response.Header {
+		header[key] = values
+	}
+	response.Body.Close()
+	response.Header = header
+	response.Body = io.NopCloser(bytes.NewReader(content))
+	response.ContentLength = int64(len(content))
+	return &httpResponse{Response: response, notModified: true}, nil
+}
@@ -0,0 +1,175 @@
+package libcore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v5/common/buf"
+)
+
+const progressInterval = 500 * time.Millisecond
+
+type DownloadListener interface {
+	// OnProgress reports downloaded and total bytes, total is -1 if unknown, speed is in bytes per second.
+	OnProgress(downloaded int64, total int64, speed int64)
+}
+
+type progressWriter struct {
+	listener   DownloadListener
+	offset     int64
+	downloaded int64
+	total      int64
+	start      time.Time
+	lastReport time.Time
+}
+
+func (w *progressWriter) Write(p []byte) (n int, err error) {
+	w.downloaded += int64(len(p))
+	if time.Since(w.lastReport) >= progressInterval {
+		w.report()
+	}
+	return len(p), nil
+}
+
+func (w *progressWriter) report() {
+	if w.listener == nil {
+		return
+	}
+	w.lastReport = time.Now()
+	var speed int64
+	if elapsed := w.lastReport.Sub(w.start); elapsed > 0 {
+		speed = int64(float64(w.downloaded-w.offset) / elapsed.Seconds())
+	}
+	w.listener.OnProgress(w.downloaded, w.total, speed)
+}
+
+func hashFile(path string, h hash.Hash) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(h, file)
+	return err
+}
+
+// parseContentRangeStart returns the first byte position of a "bytes start-end/size" header.
+func parseContentRangeStart(contentRange string) (int64, error) {
+	rangeSpec, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return 0, newError("invalid content range: ", contentRange)
+	}
+	start, _, ok := strings.Cut(rangeSpec, "-")
+	if !ok {
+		return 0, newError("invalid content range: ", contentRange)
+	}
+	return strconv.ParseInt(start, 10, 64)
+}
+
+// Download writes the response body to path + ".part", resuming an existing partial file with a Range request,
+// and renames it to path when completed. If sha256Hex is not empty, the file is verified before the rename,
+// and the partial file is removed on mismatch.
+func (r *httpRequest) Download(path string, sha256Hex string, listener DownloadListener) error {
+	partPath := path + ".part"
+	sum := sha256.New()
+
+	var offset int64
+	if info, err := os.Stat(partPath); err == nil && info.Size() > 0 {
+		if err = hashFile(partPath, sum); err == nil {
+			offset = info.Size()
+		} else {
+			sum.Reset()
+		}
+	}
+	if offset > 0 {
+		r.request.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	} else {
+		r.request.Header.Del("Range")
+	}
+
+	response, _, err := r.do()
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	flag := os.O_WRONLY | os.O_CREATE
+	switch response.StatusCode {
+	case http.StatusOK:
+		offset = 0
+		sum.Reset()
+		flag |= os.O_TRUNC
+	case http.StatusPartialContent:
+		start, err := parseContentRangeStart(response.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		if start != offset {
+			return newError("unexpected content range start ", start, ", expected ", offset)
+		}
+		flag |= os.O_APPEND
+	case http.StatusRequestedRangeNotSatisfiable:
+		if offset == 0 {
+			return errors.New((&httpResponse{Response: response}).errorString())
+		}
+		// the partial file is stale, start over with the content sent again
+		if err = os.Remove(partPath); err != nil {
+			return err
+		}
+		if r.request.GetBody != nil {
+			if r.request.Body, err = r.request.GetBody(); err != nil {
+				return err
+			}
+		}
+		return r.Download(path, sha256Hex, listener)
+	default:
+		return errors.New((&httpResponse{Response: response}).errorString())
+	}
+
+	total := int64(-1)
+	if response.ContentLength >= 0 {
+		total = offset + response.ContentLength
+	}
+	progress := &progressWriter{
+		listener:   listener,
+		offset:     offset,
+		downloaded: offset,
+		total:      total,
+		start:      time.Now(),
+	}
+
+	file, err := os.OpenFile(partPath, flag, 0o644)
+	if err != nil {
+		return err
+	}
+	buffer := buf.StackNew()
+	defer buffer.Release()
+	_, err = io.CopyBuffer(io.MultiWriter(file, sum, progress), response.Body, buffer.Extend(buf.Size))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	progress.report()
+	if err != nil {
+		return err
+	}
+
+	if sha256Hex != "" {
+		actual := hex.EncodeToString(sum.Sum(nil))
+		if !strings.EqualFold(actual, sha256Hex) {
+			_ = os.Remove(partPath)
+			return newError("sha256 mismatch: expected ", sha256Hex, ", got ", actual)
+		}
+	}
+	return os.Rename(partPath, path)
+}
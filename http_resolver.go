@@ -0,0 +1,243 @@
+package libcore
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"libcore/comm"
+)
+
+type httpResolver interface {
+	lookup(ctx context.Context, host string) ([]net.IP, error)
+}
+
+// queryResolver resolves A and AAAA records with separated queries sent by exchange.
+type queryResolver struct {
+	exchange func(ctx context.Context, query []byte) ([]byte, error)
+}
+
+func (r *queryResolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	var ips []net.IP
+	var lastErr error
+	for _, ipv6Mode := range []int32{comm.IPv6Disable, comm.IPv6Only} {
+		query, err := EncodeDomainNameSystemQuery(int32(rand.Uint32()), host, ipv6Mode)
+		if err != nil {
+			return nil, err
+		}
+		response, err := r.exchange(ctx, query)
+		if err == nil {
+			var addresses string
+			addresses, err = DecodeContentDomainNameSystemResponse(response)
+			for _, address := range strings.Fields(addresses) {
+				if ip := net.ParseIP(address); ip != nil {
+					ips = append(ips, ip)
+				}
+			}
+		}
+		if err != nil {
+			lastErr = err
+		}
+	}
+	if len(ips) == 0 {
+		if lastErr != nil {
+			return nil, newError("failed to lookup ", host).Base(lastErr)
+		}
+		return nil, newError("no ip address found for ", host)
+	}
+	return ips, nil
+}
+
+type instanceResolver struct {
+	instance *V2RayInstance
+}
+
+func (r *instanceResolver) lookup(_ context.Context, host string) ([]net.IP, error) {
+	if r.instance.dnsClient == nil {
+		return nil, newError("failed to lookup ", host, ": instance not loaded")
+	}
+	return r.instance.dnsClient.LookupIP(host)
+}
+
+type localResolver struct {
+	resolver LocalResolver
+}
+
+func (r *localResolver) lookup(_ context.Context, host string) ([]net.IP, error) {
+	response, err := r.resolver.LookupIP("ip", host)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, address := range strings.Split(response, ",") {
+		if ip := net.ParseIP(strings.TrimSpace(address)); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, newError("no ip address found for ", host)
+	}
+	return ips, nil
+}
+
+// bootstrapAddress is the address to dial a DNS server of host at, which must be an IP address unless serverIP is given,
+// otherwise resolving it would need the system resolver.
+func bootstrapAddress(host string, port string, serverIP string) (string, error) {
+	if serverIP == "" {
+		serverIP = host
+	}
+	if net.ParseIP(serverIP) == nil {
+		return "", newError("an ip address is required for DNS server ", host)
+	}
+	return net.JoinHostPort(serverIP, port), nil
+}
+
+func (c *httpClient) UseDoH(serverURL string, serverIP string) error {
+	server, err := url.Parse(serverURL)
+	if err != nil {
+		return err
+	}
+	if server.Scheme != "https" {
+		return newError("not a DoH server: ", serverURL)
+	}
+	port := server.Port()
+	if port == "" {
+		port = "443"
+	}
+	address, err := bootstrapAddress(server.Hostname(), port, serverIP)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return c.dialer.dialContext(ctx, network, address)
+			},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	c.resolver = &queryResolver{exchange: func(ctx context.Context, query []byte) ([]byte, error) {
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, serverURL, bytes.NewReader(query))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", "application/dns-message")
+		request.Header.Set("Accept", "application/dns-message")
+		response, err := client.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return nil, newError("DoH server responded ", response.Status)
+		}
+		return io.ReadAll(io.LimitReader(response.Body, 65535))
+	}}
+	return nil
+}
+
+func (c *httpClient) UseDoT(server string, serverIP string) error {
+	serverName, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return err
+	}
+	address, err := bootstrapAddress(serverName, port, serverIP)
+	if err != nil {
+		return err
+	}
+	c.resolver = &queryResolver{exchange: func(ctx context.Context, query []byte) ([]byte, error) {
+		conn, err := c.dialer.dialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName})
+		defer tlsConn.Close()
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		return exchangeStream(ctx, tlsConn, query)
+	}}
+	return nil
+}
+
+func (c *httpClient) UseInstanceDNS(instance *V2RayInstance) {
+	c.resolver = &instanceResolver{instance: instance}
+}
+
+func (c *httpClient) UseLocalResolver(resolver LocalResolver) {
+	c.resolver = &localResolver{resolver: resolver}
+}
+
+// dialContext resolves the domain with the configured resolver and tries each address,
+// without a resolver the address is passed to the dialer as is.
+func (c *httpClient) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.resolver == nil || net.ParseIP(host) != nil {
+		return c.dialer.dialContext(ctx, network, addr)
+	}
+	ips, err := c.resolver.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, newError("no ip address found for ", host)
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = c.dialer.dialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (c *httpClient) UseHTTP3() {
+	c.http3 = &http3.Transport{
+		TLSClientConfig: &c.tls,
+		Dial:            c.dialQUIC,
+	}
+	c.client.Transport = c.http3
+}
+
+func (c *httpClient) dialQUIC(ctx context.Context, addr string, tlsConfig *tls.Config, quicConfig *quic.Config) (quic.EarlyConnection, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.resolver != nil && net.ParseIP(host) == nil {
+		ips, err := c.resolver.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, newError("no ip address found for ", host)
+		}
+		addr = net.JoinHostPort(ips[0].String(), port)
+	}
+	packetConn, remoteAddr, err := c.dialer.listenPacket(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := quic.DialEarly(ctx, packetConn, remoteAddr, tlsConfig, quicConfig)
+	if err != nil {
+		packetConn.Close()
+		return nil, err
+	}
+	go func() {
+		<-conn.Context().Done()
+		packetConn.Close()
+	}()
+	return conn, nil
+}
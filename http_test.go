@@ -0,0 +1,121 @@
+package libcore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPMaxRedirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			http.Redirect(w, r, "/c", http.StatusMovedPermanently)
+		default:
+			_, _ = w.Write([]byte("ok"))
+		}
+	}))
+	defer server.Close()
+	client := NewHttpClient()
+	defer client.Close()
+
+	tests := []struct {
+		maxRedirects int32
+		status       int32
+		redirects    int
+	}{
+		{-1, http.StatusOK, 3},
+		{2, http.StatusOK, 3},
+		{1, http.StatusMovedPermanently, 2},
+		{0, http.StatusFound, 1},
+	}
+	for _, test := range tests {
+		request := client.NewRequest()
+		if err := request.SetURL(server.URL + "/a"); err != nil {
+			t.Fatal(err)
+		}
+		request.SetMaxRedirects(test.maxRedirects)
+		response, err := request.Execute()
+		if err != nil {
+			t.Errorf("max redirects %d: %v", test.maxRedirects, err)
+			continue
+		}
+		if response.GetStatusCode() != test.status {
+			t.Errorf("max redirects %d: got status %d, want %d", test.maxRedirects, response.GetStatusCode(), test.status)
+		}
+		if chain := strings.Split(response.GetRedirectChain(), "\n"); len(chain) != test.redirects {
+			t.Errorf("max redirects %d: got redirect chain %q", test.maxRedirects, chain)
+		}
+	}
+
+}
+
+func TestHTTPResolverBootstrap(t *testing.T) {
+	client := NewHttpClient().(*httpClient)
+	defer client.Close()
+	tests := []struct {
+		name string
+		use  func() error
+		ok   bool
+	}{
+		{"DoH domain", func() error { return client.UseDoH("https://dns.example.com/dns-query", "") }, false},
+		{"DoH domain with ip", func() error { return client.UseDoH("https://dns.example.com/dns-query", "192.0.2.1") }, true},
+		{"DoH ip", func() error { return client.UseDoH("https://192.0.2.1:8443/dns-query", "") }, true},
+		{"DoH domain with domain", func() error { return client.UseDoH("https://dns.example.com/dns-query", "dns.example.net") }, false},
+		{"DoH http", func() error { return client.UseDoH("http://192.0.2.1/dns-query", "") }, false},
+		{"DoT domain", func() error { return client.UseDoT("dns.example.com:853", "") }, false},
+		{"DoT domain with ip", func() error { return client.UseDoT("dns.example.com:853", "2001:db8::1") }, true},
+		{"DoT ip", func() error { return client.UseDoT("[2001:db8::1]:853", "") }, true},
+		{"DoT without port", func() error { return client.UseDoT("192.0.2.1", "") }, false},
+	}
+	for _, test := range tests {
+		if err := test.use(); (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+	}
+
+	client.UseInstanceDNS(NewV2rayInstance())
+	if _, err := client.resolver.lookup(context.Background(), "example.com"); err == nil {
+		t.Error("instance not loaded resolved a domain")
+	}
+}
+
+func TestHTTPDownloadStalePart(t *testing.T) {
+	content := bytes.Repeat([]byte("content"), 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, _ := io.ReadAll(r.Body); string(body) != "query" {
+			http.Error(w, "missing query", http.StatusBadRequest)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	client := NewHttpClient()
+	defer client.Close()
+
+	// the partial file is longer than the content, so the range is not satisfiable
+	path := t.TempDir() + "/download"
+	if err := os.WriteFile(path+".part", bytes.Repeat([]byte("stale"), 200), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	request := client.NewRequest()
+	if err := request.SetURL(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	request.SetMethod(http.MethodPost)
+	request.SetContentString("query")
+	if err := request.Download(path, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if downloaded, _ := os.ReadFile(path); !bytes.Equal(downloaded, content) {
+		t.Errorf("got %q", downloaded)
+	}
+}
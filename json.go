@@ -1,114 +1,528 @@
 package libcore
 
-// github.com/trapcodeio/go-strip-json-comments
-
-const (
-	notInsideComment = 0
-	singleComment    = 1
-	multiComment     = 2
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
-func isEscaped(jsonString string, quotePosition int) bool {
-	index := quotePosition - 1
-	backslashCount := 0
+type JSONSyntaxError struct {
+	Line    int32
+	Column  int32
+	Message string
+}
+
+func (e *JSONSyntaxError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// jsonNormalizer converts JSONC and JSON5 to JSON in a single pass. Comments are replaced by spaces
+// and line breaks are kept, so that lines in the output match the input, except for line continuations in strings.
+type jsonNormalizer struct {
+	input  string
+	pos    int
+	line   int32
+	column int32
+	output []byte
+
+	// stack of open brackets
+	stack        []byte
+	expectKey    bool
+	pendingComma int
+	// afterValue is set after a key or value until the next separator or opening bracket.
+	afterValue bool
+
+	// offsets is recorded if not nil.
+	offsets *jsonOffsetMap
+}
 
-	for string(jsonString[index]) == "\\" {
-		index -= 1
-		backslashCount += 1
+// jsonOffsetMap maps offsets in the normalized output back to the input.
+// Each segment starts at a token whose output and input offsets differ from the previous segment by a different amount.
+type jsonOffsetMap struct {
+	output []int
+	input  []int
+}
+
+func (m *jsonOffsetMap) record(output, input int) {
+	if last := len(m.output) - 1; last >= 0 && input-output == m.input[last]-m.output[last] {
+		return
 	}
+	m.output = append(m.output, output)
+	m.input = append(m.input, input)
+}
+
+// inputOffset returns the input offset of an output offset, offsets inside a token are mapped linearly from its start.
+func (m *jsonOffsetMap) inputOffset(offset int) int {
+	i := sort.SearchInts(m.output, offset+1) - 1
+	if i < 0 {
+		return offset
+	}
+	return m.input[i] + offset - m.output[i]
+}
+
+// NormalizeJSON converts JSON with comments (//, /* */ and #), trailing commas,
+// and JSON5 unquoted keys, single quoted strings, hex numbers and other number forms into standard JSON.
+// Errors are *JSONSyntaxError with the position in the input.
+func NormalizeJSON(content string) (string, error) {
+	normalized, _, err := normalizeJSON(content, false)
+	return normalized, err
+}
 
-	return backslashCount%2 == 1
+// normalizeJSON is NormalizeJSON, also returning the offset map if mapOffsets is set.
+func normalizeJSON(content string, mapOffsets bool) (string, *jsonOffsetMap, error) {
+	n := &jsonNormalizer{
+		input:        content,
+		line:         1,
+		column:       1,
+		output:       make([]byte, 0, len(content)+len(content)/16),
+		pendingComma: -1,
+	}
+	if mapOffsets {
+		n.offsets = new(jsonOffsetMap)
+	}
+	if err := n.run(); err != nil {
+		return "", nil, err
+	}
+	return string(n.output), n.offsets, nil
 }
 
-// strip comments and trailing commas  from JSON string
+// StripJSON strips comments and trailing commas from JSON string, also converting JSON5 if it is well-formed.
+// Malformed content is only stripped, so that the error of the JSON parser is reported.
 func StripJSON(jsonString string) string {
-	isInsideString := false
-	isInsideComment := notInsideComment
-	offset := 0
-	buffer := ""
-	result := ""
-	commaIndex := -1
-
-	for index := 0; index < len(jsonString); index++ {
-		currentCharacter := string(jsonString[index])
-		nextCharacter := ""
-
-		if index+1 < len(jsonString) {
-			nextCharacter = string(jsonString[index+1])
-		}
-
-		if isInsideComment == notInsideComment && currentCharacter == `"` {
-			// Enter or exit string
-			escaped := isEscaped(jsonString, index)
-			if !escaped {
-				isInsideString = !isInsideString
-			}
-		}
-
-		if isInsideString {
-			continue
-		}
-
-		if isInsideComment == notInsideComment && currentCharacter+nextCharacter == "//" {
-			// Enter single-line comment
-			buffer += jsonString[offset:index]
-			offset = index
-			isInsideComment = singleComment
-			index++
-		} else if isInsideComment == singleComment && currentCharacter+nextCharacter == "\r\n" {
-			// Exit single-line comment via \r\n
-			index++
-			isInsideComment = notInsideComment
-			offset = index
-		} else if isInsideComment == singleComment && currentCharacter == "\n" {
-			// Exit single-line comment via \n
-			isInsideComment = notInsideComment
-			offset = index
-		} else if isInsideComment == notInsideComment && currentCharacter+nextCharacter == "/*" {
-			// Enter multiline comment
-			buffer += jsonString[offset:index]
-			offset = index
-			isInsideComment = multiComment
-			index++
-
-		} else if isInsideComment == multiComment && currentCharacter+nextCharacter == "*/" {
-			// Exit multiline comment
-			index++
-			isInsideComment = notInsideComment
-			offset = index + 1
-
-		} else if isInsideComment == notInsideComment {
-			if commaIndex != -1 {
-				if currentCharacter == "}" || currentCharacter == "]" {
-					// Strip trailing comma
-					buffer += jsonString[offset:index]
-					result += buffer[1:]
-					buffer = ""
-					offset = index
-					commaIndex = -1
-				} else if currentCharacter != " " && currentCharacter != "\t" && currentCharacter != "\r" && currentCharacter != "\n" {
-					// Hit non-whitespace following a comma; comma is not trailing
-					buffer += jsonString[offset:index]
-					offset = index
-					commaIndex = -1
+	normalized, err := NormalizeJSON(jsonString)
+	if err != nil {
+		return stripJSON(jsonString)
+	}
+	return normalized
+}
+
+// stripJSON replaces comments by spaces and removes trailing commas, copying everything else as is.
+func stripJSON(content string) string {
+	output := make([]byte, 0, len(content))
+	pendingComma := -1
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case c == '"' || c == '\'':
+			start := i
+			for i++; i < len(content) && content[i] != c && content[i] != '\n'; i++ {
+				if content[i] == '\\' {
+					i++
 				}
-			} else if currentCharacter == "," {
-				// Flush buffer prior to this point, and save new comma index
-				result += buffer + jsonString[offset:index]
-				buffer = ""
-				offset = index
-				commaIndex = index
+			}
+			i = min(i+1, len(content))
+			output = append(output, content[start:i]...)
+			pendingComma = -1
+		case c == '#' || c == '/' && strings.HasPrefix(content[i:], "//"):
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+			output = append(output, ' ')
+		case strings.HasPrefix(content[i:], "/*"):
+			end := len(content)
+			if index := strings.Index(content[i+2:], "*/"); index >= 0 {
+				end = i + 2 + index + 2
+			}
+			output = append(output, ' ')
+			output = append(output, strings.Repeat("\n", strings.Count(content[i:end], "\n"))...)
+			i = end
+		case c == ',':
+			pendingComma = len(output)
+			output = append(output, c)
+			i++
+		case c == '}' || c == ']':
+			if pendingComma >= 0 {
+				output[pendingComma] = ' '
+			}
+			pendingComma = -1
+			output = append(output, c)
+			i++
+		default:
+			if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+				pendingComma = -1
+			}
+			output = append(output, c)
+			i++
+		}
+	}
+	return string(output)
+}
 
+func (n *jsonNormalizer) errorf(line, column int32, format string, a ...interface{}) error {
+	return &JSONSyntaxError{Line: line, Column: column, Message: fmt.Sprintf(format, a...)}
+}
+
+func (n *jsonNormalizer) peek(offset int) byte {
+	if n.pos+offset < len(n.input) {
+		return n.input[n.pos+offset]
+	}
+	return 0
+}
+
+// advance moves forward by one byte, counting columns in characters.
+func (n *jsonNormalizer) advance() byte {
+	c := n.input[n.pos]
+	n.pos++
+	if c == '\n' {
+		n.line++
+		n.column = 1
+	} else if c&0xC0 != 0x80 {
+		n.column++
+	}
+	return c
+}
+
+func (n *jsonNormalizer) copyByte() {
+	n.output = append(n.output, n.advance())
+}
+
+func (n *jsonNormalizer) run() error {
+	for n.pos < len(n.input) {
+		if n.offsets != nil {
+			n.offsets.record(len(n.output), n.pos)
+		}
+		c := n.input[n.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			n.copyByte()
+		case c == '#' || c == '/' && n.peek(1) == '/':
+			n.skipLineComment()
+		case c == '/' && n.peek(1) == '*':
+			if err := n.skipBlockComment(); err != nil {
+				return err
+			}
+		case c == '{' || c == '[':
+			if err := n.valueStart(); err != nil {
+				return err
+			}
+			n.stack = append(n.stack, c)
+			n.expectKey = c == '{'
+			n.copyByte()
+		case c == '}' || c == ']':
+			open := byte('{')
+			if c == ']' {
+				open = '['
+			}
+			if len(n.stack) == 0 || n.stack[len(n.stack)-1] != open {
+				return n.errorf(n.line, n.column, "unexpected %q", c)
+			}
+			if n.pendingComma >= 0 {
+				n.output[n.pendingComma] = ' '
+				n.pendingComma = -1
+			}
+			n.stack = n.stack[:len(n.stack)-1]
+			n.expectKey = false
+			n.afterValue = true
+			n.copyByte()
+		case c == ',':
+			if len(n.stack) == 0 || n.pendingComma >= 0 {
+				return n.errorf(n.line, n.column, "unexpected ','")
+			}
+			n.pendingComma = len(n.output)
+			n.expectKey = n.stack[len(n.stack)-1] == '{'
+			n.afterValue = false
+			n.copyByte()
+		case c == ':':
+			n.expectKey = false
+			n.afterValue = false
+			n.copyByte()
+		case c == '"' || c == '\'':
+			if err := n.valueStart(); err != nil {
+				return err
+			}
+			if err := n.string(); err != nil {
+				return err
+			}
+			n.afterValue = true
+		case c >= '0' && c <= '9' || c == '-' || c == '+' || c == '.':
+			if err := n.valueStart(); err != nil {
+				return err
+			}
+			if err := n.number(); err != nil {
+				return err
+			}
+			n.afterValue = true
+		default:
+			r, size := utf8.DecodeRuneInString(n.input[n.pos:])
+			switch {
+			case isJSONIdentifierStart(r):
+				if err := n.valueStart(); err != nil {
+					return err
+				}
+				if err := n.identifier(); err != nil {
+					return err
+				}
+				n.afterValue = true
+			case r == '\uFEFF' || unicode.IsSpace(r):
+				for i := 0; i < size; i++ {
+					n.advance()
+				}
+				n.output = append(n.output, ' ')
+			default:
+				return n.errorf(n.line, n.column, "unexpected character %q", r)
 			}
 		}
 	}
+	if n.offsets != nil {
+		n.offsets.record(len(n.output), n.pos)
+	}
+	if len(n.stack) > 0 {
+		return n.errorf(n.line, n.column, "unexpected end of input, %q is not closed", n.stack[len(n.stack)-1])
+	}
+	return nil
+}
 
-	var end string
-	if isInsideComment > notInsideComment {
-		end = ""
-	} else {
-		end = jsonString[offset:]
+// valueStart marks the comma before a key or value as not trailing,
+// a key or value directly after another one is missing a comma.
+func (n *jsonNormalizer) valueStart() error {
+	if n.afterValue {
+		if len(n.stack) == 0 {
+			return n.errorf(n.line, n.column, "unexpected value after the end of input")
+		}
+		if n.expectKey && n.stack[len(n.stack)-1] == '{' {
+			return n.errorf(n.line, n.column, "missing ':' after key")
+		}
+		return n.errorf(n.line, n.column, "missing ',' before value")
+	}
+	n.pendingComma = -1
+	return nil
+}
+
+func (n *jsonNormalizer) skipLineComment() {
+	for n.pos < len(n.input) && n.input[n.pos] != '\n' && n.input[n.pos] != '\r' {
+		n.advance()
+	}
+	n.output = append(n.output, ' ')
+}
+
+func (n *jsonNormalizer) skipBlockComment() error {
+	line, column := n.line, n.column
+	n.advance()
+	n.advance()
+	for n.pos < len(n.input) {
+		if n.input[n.pos] == '*' && n.peek(1) == '/' {
+			n.advance()
+			n.advance()
+			n.output = append(n.output, ' ')
+			return nil
+		}
+		if c := n.advance(); c == '\n' {
+			n.output = append(n.output, '\n')
+		}
+	}
+	return n.errorf(line, column, "unterminated comment")
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func (n *jsonNormalizer) string() error {
+	line, column := n.line, n.column
+	quote := n.advance()
+	n.output = append(n.output, '"')
+	for {
+		if n.pos >= len(n.input) {
+			return n.errorf(line, column, "unterminated string")
+		}
+		c := n.input[n.pos]
+		switch {
+		case c == quote:
+			n.advance()
+			n.output = append(n.output, '"')
+			return nil
+		case c == '\n' || c == '\r':
+			return n.errorf(line, column, "unterminated string")
+		case c == '"':
+			n.advance()
+			n.output = append(n.output, '\\', '"')
+		case c == '\\':
+			if err := n.escape(); err != nil {
+				return err
+			}
+		case c < 0x20:
+			n.advance()
+			n.output = fmt.Appendf(n.output, `\u%04x`, c)
+		default:
+			n.copyByte()
+		}
+	}
+}
+
+func (n *jsonNormalizer) escape() error {
+	line, column := n.line, n.column
+	n.advance()
+	if n.pos >= len(n.input) {
+		return n.errorf(line, column, "unterminated string")
+	}
+	c := n.input[n.pos]
+	switch c {
+	case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+		n.advance()
+		n.output = append(n.output, '\\', c)
+	case '\'':
+		n.advance()
+		n.output = append(n.output, '\'')
+	case 'v':
+		n.advance()
+		n.output = append(n.output, `\u000b`...)
+	case '0':
+		if next := n.peek(1); next >= '0' && next <= '9' {
+			return n.errorf(line, column, "octal escape is not allowed")
+		}
+		n.advance()
+		n.output = append(n.output, `\u0000`...)
+	case 'x', 'u':
+		digits := 2
+		if c == 'u' {
+			digits = 4
+		}
+		for i := 1; i <= digits; i++ {
+			if !isHexDigit(n.peek(i)) {
+				return n.errorf(line, column, "invalid escape sequence")
+			}
+		}
+		n.advance()
+		n.output = append(n.output, `\u`...)
+		if c == 'x' {
+			n.output = append(n.output, "00"...)
+		}
+		for i := 0; i < digits; i++ {
+			n.copyByte()
+		}
+	case '\r', '\n':
+		// line continuation
+		if n.advance() == '\r' && n.peek(0) == '\n' {
+			n.advance()
+		}
+	case '\t':
+		n.advance()
+		n.output = append(n.output, '\\', 't')
+	default:
+		if c < 0x20 {
+			n.advance()
+			n.output = fmt.Appendf(n.output, `\u%04x`, c)
+			return nil
+		}
+		if c >= '1' && c <= '9' {
+			return n.errorf(line, column, "invalid escape sequence")
+		}
+		// other characters escape themselves
+		_, size := utf8.DecodeRuneInString(n.input[n.pos:])
+		for i := 0; i < size; i++ {
+			n.copyByte()
+		}
+	}
+	return nil
+}
+
+func (n *jsonNormalizer) number() error {
+	line, column := n.line, n.column
+	switch n.input[n.pos] {
+	case '+':
+		n.advance()
+	case '-':
+		n.output = append(n.output, n.advance())
+	}
+	rest := n.input[n.pos:]
+	if strings.HasPrefix(rest, "Infinity") || strings.HasPrefix(rest, "NaN") {
+		return n.errorf(line, column, "Infinity and NaN are not allowed in JSON")
 	}
 
-	return result + buffer + end
+	if n.peek(0) == '0' && (n.peek(1) == 'x' || n.peek(1) == 'X') {
+		n.advance()
+		n.advance()
+		start := n.pos
+		for n.pos < len(n.input) && isHexDigit(n.input[n.pos]) {
+			n.advance()
+		}
+		value, ok := new(big.Int).SetString(n.input[start:n.pos], 16)
+		if !ok {
+			return n.errorf(line, column, "invalid hexadecimal number")
+		}
+		n.output = value.Append(n.output, 10)
+		return nil
+	}
+
+	digits := func() string {
+		start := n.pos
+		for n.pos < len(n.input) && n.input[n.pos] >= '0' && n.input[n.pos] <= '9' {
+			n.advance()
+		}
+		return n.input[start:n.pos]
+	}
+	integer := digits()
+	var fraction string
+	hasPoint := n.peek(0) == '.'
+	if hasPoint {
+		n.advance()
+		fraction = digits()
+	}
+	if integer == "" && fraction == "" {
+		return n.errorf(line, column, "invalid number")
+	}
+	if integer == "" {
+		integer = "0"
+	} else if len(integer) > 1 && integer[0] == '0' {
+		return n.errorf(line, column, "leading zeros are not allowed")
+	}
+	n.output = append(n.output, integer...)
+	if fraction != "" {
+		n.output = append(n.output, '.')
+		n.output = append(n.output, fraction...)
+	}
+	if c := n.peek(0); c == 'e' || c == 'E' {
+		n.copyByte()
+		if c := n.peek(0); c == '+' || c == '-' {
+			n.copyByte()
+		}
+		exponent := digits()
+		if exponent == "" {
+			return n.errorf(line, column, "invalid number")
+		}
+		n.output = append(n.output, exponent...)
+	}
+	return nil
+}
+
+func isJSONIdentifierStart(r rune) bool {
+	return r == '$' || r == '_' || unicode.IsLetter(r)
+}
+
+func isJSONIdentifierPart(r rune) bool {
+	return isJSONIdentifierStart(r) || unicode.IsDigit(r) || r == '\u200C' || r == '\u200D' ||
+		unicode.In(r, unicode.Mn, unicode.Mc, unicode.Pc)
+}
+
+func (n *jsonNormalizer) identifier() error {
+	line, column := n.line, n.column
+	start := n.pos
+	for n.pos < len(n.input) {
+		r, size := utf8.DecodeRuneInString(n.input[n.pos:])
+		if !isJSONIdentifierPart(r) {
+			break
+		}
+		for i := 0; i < size; i++ {
+			n.advance()
+		}
+	}
+	name := n.input[start:n.pos]
+	if n.expectKey {
+		n.output = append(n.output, '"')
+		n.output = append(n.output, name...)
+		n.output = append(n.output, '"')
+		return nil
+	}
+	switch name {
+	case "true", "false", "null":
+		n.output = append(n.output, name...)
+		return nil
+	case "Infinity", "NaN":
+		return n.errorf(line, column, "Infinity and NaN are not allowed in JSON")
+	default:
+		return n.errorf(line, column, "unexpected identifier %q", name)
+	}
 }
@@ -0,0 +1,78 @@
+package libcore
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestNormalizeJSON(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"{a: 1, // comment\n b: [1, 2,],}", "{\"a\": 1,  \n \"b\": [1, 2 ] }"},
+		{"{'a': 0x10, /* c */ \"b\": .5}", "{\"a\": 16,   \"b\": 0.5}"},
+		{"[\"a\\\tb\", 'c\\\x01d', 'e\\'f\"g']", "[\"a\\tb\", \"c\\u0001d\", \"e'f\\\"g\"]"},
+	}
+	for _, test := range tests {
+		got, err := NormalizeJSON(test.input)
+		if err != nil {
+			t.Errorf("%q: %v", test.input, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.input, got, test.want)
+		}
+		if !json.Valid([]byte(got)) {
+			t.Errorf("%q: invalid output %q", test.input, got)
+		}
+	}
+}
+
+func TestNormalizeJSONError(t *testing.T) {
+	tests := []struct {
+		input  string
+		line   int32
+		column int32
+	}{
+		{"[1 2]", 1, 4},
+		{"{\"a\": 1\n \"b\": 2}", 2, 2},
+		{"{\"a\" 1}", 1, 6},
+		{"{} {}", 1, 4},
+		{"[1,,2]", 1, 4},
+		{"{\"a\": 'b\n'}", 1, 7},
+		{"[1, /* 2", 1, 5},
+		{"{\"a\": 007}", 1, 7},
+		{"[-01.5]", 1, 2},
+	}
+	for _, test := range tests {
+		_, err := NormalizeJSON(test.input)
+		var syntaxError *JSONSyntaxError
+		if !errors.As(err, &syntaxError) {
+			t.Errorf("%q: got %v, want a syntax error", test.input, err)
+			continue
+		}
+		if syntaxError.Line != test.line || syntaxError.Column != test.column {
+			t.Errorf("%q: got %v, want line %d, column %d", test.input, err, test.line, test.column)
+		}
+	}
+}
+
+func TestStripJSON(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"{a: 1, // comment\n b: [1, 2,],}", "{\"a\": 1,  \n \"b\": [1, 2 ] }"},
+		// malformed content is stripped without converting it
+		{"{\"a\": 007, /* c\n */ \"b\": [1,],}", "{\"a\": 007,  \n \"b\": [1 ] }"},
+		{"{\"a\": \"//\\\" #,}\" # comment\n,}", "{\"a\": \"//\\\" #,}\"  \n }"},
+		{"[1 2, // comment", "[1 2,  "},
+	}
+	for _, test := range tests {
+		if got := StripJSON(test.input); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.input, got, test.want)
+		}
+	}
+}
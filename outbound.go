@@ -0,0 +1,495 @@
+package libcore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/v2fly/v2ray-core/v5/common"
+	"github.com/v2fly/v2ray-core/v5/common/registry"
+	"github.com/v2fly/v2ray-core/v5/transport/internet/reality"
+)
+
+func init() {
+	// reality is only registered for v4 configs, register its alias so that v5 configs can use it.
+	common.Must(registry.RegisterImplementation((*reality.Config)(nil), nil))
+}
+
+// proxyServer is the protocol independent form of a proxy server,
+// shared by the share link and subscription parsers and converted to and from V2Ray v5 JSON outbounds.
+type proxyServer struct {
+	Name string
+	// Protocol is one of vmess, vless, trojan, shadowsocks, shadowsocks2022 and hysteria2,
+	// shadowsocksr is shadowsocks with the shadowsocksr plugin.
+	Protocol string
+	Address  string
+	Port     uint32
+
+	UUID     string
+	Password string
+	Method   string
+
+	Plugin     string
+	PluginOpts string
+	PluginArgs []string
+
+	// Transport is one of tcp, ws, grpc, httpupgrade, h2, splithttp, kcp and hysteria2.
+	Transport           string
+	Host                string
+	Path                string
+	ServiceName         string
+	MaxEarlyData        int32
+	EarlyDataHeaderName string
+	Seed                string
+	ObfsType            string
+	ObfsPassword        string
+	UpMbps              uint64
+	DownMbps            uint64
+
+	// Security is none, tls or reality.
+	Security    string
+	ServerName  string
+	ALPN        []string
+	Fingerprint string
+	// ECHConfig is base64 encoded.
+	ECHConfig string
+	// PublicKey is base64url encoded and ShortID is hex encoded as in share links.
+	PublicKey string
+	ShortID   string
+	SpiderX   string
+}
+
+type v5Outbound struct {
+	Protocol       string              `json:"protocol"`
+	Tag            string              `json:"tag,omitempty"`
+	Settings       *v5OutboundSettings `json:"settings"`
+	StreamSettings *v5StreamSettings   `json:"streamSettings,omitempty"`
+}
+
+type v5ServerEndpoint struct {
+	Address string `json:"address"`
+	Port    uint32 `json:"port"`
+}
+
+type v5OutboundSettings struct {
+	Address    string              `json:"address,omitempty"`
+	Port       uint32              `json:"port,omitempty"`
+	UUID       string              `json:"uuid,omitempty"`
+	Password   string              `json:"password,omitempty"`
+	Method     string              `json:"method,omitempty"`
+	PSK        string              `json:"psk,omitempty"`
+	IPSK       []string            `json:"ipsk,omitempty"`
+	Plugin     string              `json:"plugin,omitempty"`
+	PluginOpts string              `json:"pluginOpts,omitempty"`
+	PluginArgs []string            `json:"pluginArgs,omitempty"`
+	Server     []*v5ServerEndpoint `json:"server,omitempty"`
+}
+
+type v5StreamSettings struct {
+	Transport         string               `json:"transport,omitempty"`
+	TransportSettings *v5TransportSettings `json:"transportSettings,omitempty"`
+	Security          string               `json:"security,omitempty"`
+	SecuritySettings  *v5SecuritySettings  `json:"securitySettings,omitempty"`
+}
+
+type v5Header struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type v5TransportSettings struct {
+	Path string `json:"path,omitempty"`
+	// Host is a string, or a list of strings for h2.
+	Host                interface{}   `json:"host,omitempty"`
+	Header              []*v5Header   `json:"header,omitempty"`
+	ServiceName         string        `json:"serviceName,omitempty"`
+	MaxEarlyData        int32         `json:"maxEarlyData,omitempty"`
+	EarlyDataHeaderName string        `json:"earlyDataHeaderName,omitempty"`
+	Seed                *v5KCPSeed    `json:"seed,omitempty"`
+	Password            string        `json:"password,omitempty"`
+	Congestion          *v5Congestion `json:"congestion,omitempty"`
+	Obfs                *v5Obfs       `json:"obfs,omitempty"`
+}
+
+type v5KCPSeed struct {
+	Seed string `json:"seed"`
+}
+
+type v5Congestion struct {
+	UpMbps   uint64 `json:"upMbps,omitempty"`
+	DownMbps uint64 `json:"downMbps,omitempty"`
+}
+
+type v5Obfs struct {
+	Type     string `json:"type"`
+	Password string `json:"password"`
+}
+
+type v5SecuritySettings struct {
+	ServerName   string   `json:"serverName,omitempty"`
+	NextProtocol []string `json:"nextProtocol,omitempty"`
+	ECHConfig    string   `json:"echConfig,omitempty"`
+
+	// utls
+	TLSConfig *v5SecuritySettings `json:"tlsConfig,omitempty"`
+	Imitate   string              `json:"imitate,omitempty"`
+
+	// reality
+	Fingerprint string  `json:"Fingerprint,omitempty"`
+	PublicKey   []byte  `json:"publicKey,omitempty"`
+	ShortID     []byte  `json:"shortId,omitempty"`
+	SpiderX     string  `json:"spiderX,omitempty"`
+	SpiderY     []int64 `json:"spiderY,omitempty"`
+	Version     []byte  `json:"version,omitempty"`
+}
+
+type v5BalancingRule struct {
+	Tag              string   `json:"tag"`
+	OutboundSelector []string `json:"outboundSelector"`
+	Strategy         string   `json:"strategy"`
+}
+
+func (s *proxyServer) outbound() (*v5Outbound, error) {
+	if s.Address == "" || s.Port == 0 {
+		return nil, newError("missing server address or port")
+	}
+	outbound := &v5Outbound{
+		Protocol: s.Protocol,
+		Tag:      s.Name,
+		Settings: &v5OutboundSettings{
+			Address: s.Address,
+			Port:    s.Port,
+		},
+	}
+	settings := outbound.Settings
+	transportName, securityName := s.Transport, s.Security
+	switch s.Protocol {
+	case "vmess", "vless":
+		if s.UUID == "" {
+			return nil, newError("missing uuid")
+		}
+		settings.UUID = s.UUID
+	case "trojan":
+		settings.Password = s.Password
+	case "shadowsocks":
+		settings.Method = s.Method
+		settings.Password = s.Password
+		settings.Plugin = s.Plugin
+		settings.PluginOpts = s.PluginOpts
+		settings.PluginArgs = s.PluginArgs
+	case "shadowsocks2022":
+		// the password of a multi-user server is in the format of ipsk:...:psk
+		keys := strings.Split(s.Password, ":")
+		settings.Method = s.Method
+		settings.PSK = keys[len(keys)-1]
+		settings.IPSK = keys[:len(keys)-1]
+		settings.Plugin = s.Plugin
+		settings.PluginOpts = s.PluginOpts
+		settings.PluginArgs = s.PluginArgs
+	case "hysteria2":
+		outbound.Settings = &v5OutboundSettings{
+			Server: []*v5ServerEndpoint{{Address: s.Address, Port: s.Port}},
+		}
+		transportName = "hysteria2"
+		if securityName == "" || securityName == "none" {
+			securityName = "tls"
+		}
+	default:
+		return nil, newError("unsupported protocol: ", s.Protocol)
+	}
+
+	stream := new(v5StreamSettings)
+	transport := new(v5TransportSettings)
+	switch transportName {
+	case "", "tcp":
+	case "ws":
+		transport.Path = s.Path
+		if s.Host != "" {
+			transport.Header = []*v5Header{{Key: "Host", Value: s.Host}}
+		}
+		transport.MaxEarlyData = s.MaxEarlyData
+		transport.EarlyDataHeaderName = s.EarlyDataHeaderName
+	case "grpc":
+		transport.ServiceName = s.ServiceName
+		if s.Host != "" {
+			transport.Host = s.Host
+		}
+	case "httpupgrade", "splithttp":
+		transport.Path = s.Path
+		if s.Host != "" {
+			transport.Host = s.Host
+		}
+	case "h2":
+		transport.Path = s.Path
+		if s.Host != "" {
+			transport.Host = strings.Split(s.Host, ",")
+		}
+	case "kcp":
+		if s.Seed != "" {
+			transport.Seed = &v5KCPSeed{Seed: s.Seed}
+		}
+	case "hysteria2":
+		transport.Password = s.Password
+		if s.ObfsType != "" {
+			transport.Obfs = &v5Obfs{Type: s.ObfsType, Password: s.ObfsPassword}
+		}
+		if s.UpMbps > 0 || s.DownMbps > 0 {
+			transport.Congestion = &v5Congestion{UpMbps: s.UpMbps, DownMbps: s.DownMbps}
+		}
+	default:
+		return nil, newError("unsupported transport: ", transportName)
+	}
+	if transportName != "" && transportName != "tcp" {
+		stream.Transport = transportName
+		stream.TransportSettings = transport
+	}
+
+	switch securityName {
+	case "", "none":
+	case "tls":
+		tlsSettings := &v5SecuritySettings{
+			ServerName:   s.ServerName,
+			NextProtocol: s.ALPN,
+			ECHConfig:    s.ECHConfig,
+		}
+		if s.Fingerprint == "" {
+			stream.Security = "tls"
+			stream.SecuritySettings = tlsSettings
+		} else {
+			stream.Security = "utls"
+			stream.SecuritySettings = &v5SecuritySettings{
+				TLSConfig: tlsSettings,
+				Imitate:   utlsImitate(s.Fingerprint),
+			}
+		}
+	case "reality":
+		realitySettings, err := s.realitySettings()
+		if err != nil {
+			return nil, err
+		}
+		stream.Security = "reality"
+		stream.SecuritySettings = realitySettings
+	default:
+		return nil, newError("unsupported security: ", securityName)
+	}
+
+	if stream.Transport != "" || stream.Security != "" {
+		outbound.StreamSettings = stream
+	}
+	return outbound, nil
+}
+
+// realitySpiderParams are the query parameters of spiderX moved into spiderY, each as a range of two numbers.
+var realitySpiderParams = []string{"p", "c", "t", "i", "r"}
+
+// realitySettings builds the client settings of reality in the same way as realitySettings of v4 configs.
+func (s *proxyServer) realitySettings() (*v5SecuritySettings, error) {
+	fingerprint := strings.ToLower(s.Fingerprint)
+	if fingerprint == "" {
+		fingerprint = "chrome"
+	}
+	if reality.GetFingerprint(fingerprint) == nil || fingerprint == "hellogolang" {
+		return nil, newError("unsupported reality fingerprint: ", s.Fingerprint)
+	}
+	publicKey, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s.PublicKey, "="))
+	if err != nil || len(publicKey) != 32 {
+		return nil, newError("invalid reality public key: ", s.PublicKey)
+	}
+	shortID := make([]byte, 8)
+	if len(s.ShortID) > 16 {
+		return nil, newError("invalid reality short id: ", s.ShortID)
+	}
+	if _, err = hex.Decode(shortID, []byte(s.ShortID)); err != nil {
+		return nil, newError("invalid reality short id: ", s.ShortID).Base(err)
+	}
+	spiderX := s.SpiderX
+	if spiderX == "" {
+		spiderX = "/"
+	}
+	spider, err := url.Parse(spiderX)
+	if err != nil || spiderX[0] != '/' {
+		return nil, newError("invalid reality spider x: ", s.SpiderX)
+	}
+	query := spider.Query()
+	spiderY := make([]int64, 2*len(realitySpiderParams))
+	for i, param := range realitySpiderParams {
+		if value := query.Get(param); value != "" {
+			from, to, found := strings.Cut(value, "-")
+			if !found {
+				to = from
+			}
+			spiderY[2*i], _ = strconv.ParseInt(from, 10, 64)
+			spiderY[2*i+1], _ = strconv.ParseInt(to, 10, 64)
+		}
+		query.Del(param)
+	}
+	spider.RawQuery = query.Encode()
+	return &v5SecuritySettings{
+		ServerName:  s.ServerName,
+		Fingerprint: fingerprint,
+		PublicKey:   publicKey,
+		ShortID:     shortID,
+		SpiderX:     spider.String(),
+		SpiderY:     spiderY,
+		Version:     make([]byte, 3),
+	}, nil
+}
+
+// setRealitySettings is the reverse of realitySettings.
+func (s *proxyServer) setRealitySettings(settings *v5SecuritySettings) {
+	s.ServerName = settings.ServerName
+	s.Fingerprint = settings.Fingerprint
+	s.PublicKey = base64.RawURLEncoding.EncodeToString(settings.PublicKey)
+	s.ShortID = hex.EncodeToString(bytes.TrimRight(settings.ShortID, "\x00"))
+	spider, err := url.Parse(settings.SpiderX)
+	if err != nil {
+		s.SpiderX = settings.SpiderX
+		return
+	}
+	query := spider.Query()
+	for i, param := range realitySpiderParams {
+		if 2*i+1 >= len(settings.SpiderY) {
+			break
+		}
+		from, to := settings.SpiderY[2*i], settings.SpiderY[2*i+1]
+		switch {
+		case from == 0 && to == 0:
+		case from == to:
+			query.Set(param, strconv.FormatInt(from, 10))
+		default:
+			query.Set(param, strconv.FormatInt(from, 10)+"-"+strconv.FormatInt(to, 10))
+		}
+	}
+	spider.RawQuery = query.Encode()
+	s.SpiderX = spider.String()
+	if s.SpiderX == "/" {
+		s.SpiderX = ""
+	}
+}
+
+// utlsImitate maps the fingerprint names used in share links to the preset names of the utls security.
+func utlsImitate(fingerprint string) string {
+	switch fingerprint = strings.ToLower(fingerprint); fingerprint {
+	case "random":
+		return "randomized"
+	case "randomized", "randomizedalpn", "randomizednoalpn", "golang":
+		return fingerprint
+	}
+	if strings.Contains(fingerprint, "_") {
+		return fingerprint
+	}
+	return fingerprint + "_auto"
+}
+
+func newProxyServer(outbound *v5Outbound) (*proxyServer, error) {
+	settings := outbound.Settings
+	if settings == nil {
+		return nil, newError("missing outbound settings")
+	}
+	s := &proxyServer{
+		Name:       outbound.Tag,
+		Protocol:   outbound.Protocol,
+		Address:    settings.Address,
+		Port:       settings.Port,
+		UUID:       settings.UUID,
+		Password:   settings.Password,
+		Method:     settings.Method,
+		Plugin:     settings.Plugin,
+		PluginOpts: settings.PluginOpts,
+		PluginArgs: settings.PluginArgs,
+	}
+	switch outbound.Protocol {
+	case "vmess", "vless", "trojan", "shadowsocks":
+	case "shadowsocks2022":
+		s.Password = strings.Join(append(append([]string(nil), settings.IPSK...), settings.PSK), ":")
+	case "hysteria2":
+		if len(settings.Server) == 0 {
+			return nil, newError("missing hysteria2 server")
+		}
+		s.Address = settings.Server[0].Address
+		s.Port = settings.Server[0].Port
+	default:
+		return nil, newError("unsupported protocol: ", outbound.Protocol)
+	}
+
+	stream := outbound.StreamSettings
+	if stream == nil {
+		return s, nil
+	}
+	s.Transport = stream.Transport
+	if transport := stream.TransportSettings; transport != nil {
+		s.Path = transport.Path
+		s.ServiceName = transport.ServiceName
+		s.MaxEarlyData = transport.MaxEarlyData
+		s.EarlyDataHeaderName = transport.EarlyDataHeaderName
+		switch host := transport.Host.(type) {
+		case string:
+			s.Host = host
+		case []interface{}:
+			var hosts []string
+			for _, h := range host {
+				if h, ok := h.(string); ok {
+					hosts = append(hosts, h)
+				}
+			}
+			s.Host = strings.Join(hosts, ",")
+		}
+		for _, header := range transport.Header {
+			if strings.EqualFold(header.Key, "Host") {
+				s.Host = header.Value
+			}
+		}
+		if transport.Seed != nil {
+			s.Seed = transport.Seed.Seed
+		}
+		if stream.Transport == "hysteria2" {
+			s.Password = transport.Password
+		}
+		if transport.Obfs != nil {
+			s.ObfsType = transport.Obfs.Type
+			s.ObfsPassword = transport.Obfs.Password
+		}
+		if transport.Congestion != nil {
+			s.UpMbps = transport.Congestion.UpMbps
+			s.DownMbps = transport.Congestion.DownMbps
+		}
+	}
+
+	s.Security = stream.Security
+	security := stream.SecuritySettings
+	if security == nil {
+		return s, nil
+	}
+	switch stream.Security {
+	case "utls":
+		s.Security = "tls"
+		s.Fingerprint = strings.TrimSuffix(security.Imitate, "_auto")
+		if security.TLSConfig != nil {
+			security = security.TLSConfig
+		}
+		fallthrough
+	case "tls":
+		s.ServerName = security.ServerName
+		s.ALPN = security.NextProtocol
+		s.ECHConfig = security.ECHConfig
+	case "reality":
+		s.setRealitySettings(security)
+	}
+	return s, nil
+}
+
+func (s *proxyServer) outboundJSON() (string, error) {
+	outbound, err := s.outbound()
+	if err != nil {
+		return "", err
+	}
+	content, err := json.Marshal(outbound)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
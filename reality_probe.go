@@ -0,0 +1,145 @@
+package libcore
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+type RealityProbeResult struct {
+	// BrowserHandshake is whether the server accepts a handshake with a Chrome ClientHello.
+	BrowserHandshake bool
+	TLSVersion       string
+	ALPN             string
+
+	TLS13  bool
+	X25519 bool
+	H2     bool
+
+	// CertificateSANs is a comma separated list of DNS names and IP addresses in the leaf certificate.
+	CertificateSANs string
+	SNICovered      bool
+
+	// SuitableAsRealityDest is true if all of the above checks pass, otherwise Reason explains the first failed one.
+	SuitableAsRealityDest bool
+	Reason                string
+}
+
+func probeHandshake(ctx context.Context, conn net.Conn, config *tls.Config) (*tls.ConnectionState, error) {
+	tlsConn := tls.Client(conn, config)
+	err := tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	state := tlsConn.ConnectionState()
+	return &state, nil
+}
+
+func browserHandshake(ctx context.Context, conn net.Conn, sni string) (*utls.ConnectionState, error) {
+	uConn := utls.UClient(conn, &utls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         sni,
+	}, utls.HelloChrome_Auto)
+	err := uConn.HandshakeContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	state := uConn.ConnectionState()
+	return &state, nil
+}
+
+func (d *outboundDialer) probeReality(ctx context.Context, address, sni string) (*RealityProbeResult, error) {
+	if sni == "" || net.ParseIP(sni) != nil {
+		return nil, newError("a domain name is required as sni")
+	}
+	result := new(RealityProbeResult)
+
+	// connection errors are fatal, handshake errors are part of the result
+	conn, err := d.dialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	browserState, err := browserHandshake(ctx, conn, sni)
+	conn.Close()
+	if err == nil {
+		result.BrowserHandshake = true
+		result.TLSVersion = tls.VersionName(browserState.Version)
+		result.ALPN = browserState.NegotiatedProtocol
+	}
+
+	conn, err = d.dialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	state, err := probeHandshake(ctx, conn, &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         sni,
+		MinVersion:         tls.VersionTLS13,
+		NextProtos:         []string{"h2"},
+	})
+	if err == nil {
+		result.TLS13 = true
+		result.H2 = state.NegotiatedProtocol == "h2"
+		if len(state.PeerCertificates) > 0 {
+			leaf := state.PeerCertificates[0]
+			result.CertificateSANs = certificateHostSANs(leaf)
+			result.SNICovered = leaf.VerifyHostname(sni) == nil
+		}
+	}
+	conn.Close()
+
+	conn, err = d.dialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	_, err = probeHandshake(ctx, conn, &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         sni,
+		MinVersion:         tls.VersionTLS13,
+		CurvePreferences:   []tls.CurveID{tls.X25519},
+	})
+	conn.Close()
+	result.X25519 = err == nil
+
+	switch {
+	case !result.BrowserHandshake:
+		result.Reason = "browser handshake rejected"
+	case !result.TLS13:
+		result.Reason = "TLS 1.3 not supported"
+	case !result.X25519:
+		result.Reason = "X25519 not supported"
+	case !result.H2:
+		result.Reason = "h2 not supported"
+	case !result.SNICovered:
+		result.Reason = "certificate does not cover " + sni
+	default:
+		result.SuitableAsRealityDest = true
+	}
+	return result, nil
+}
+
+func certificateHostSANs(cert *x509.Certificate) string {
+	sans := append([]string(nil), cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return strings.Join(sans, ",")
+}
+
+// ProbeRealityDest checks whether the server at address can be used as the dest of a REALITY inbound for the sni.
+func ProbeRealityDest(address, sni string, useSOCKS5 bool, socksPort int32) (*RealityProbeResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return newOutboundDialer(useSOCKS5, int(socksPort)).probeReality(ctx, address, sni)
+}
+
+func ProbeRealityDestWithInstance(instance *V2RayInstance, outboundTag, address, sni string) (*RealityProbeResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return newInstanceDialer(instance, outboundTag).probeReality(ctx, address, sni)
+}
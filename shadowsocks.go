@@ -0,0 +1,121 @@
+package libcore
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/v2fly/v2ray-core/v5/proxy/sip003/self"
+)
+
+// setPlugin sets the SIP003 plugin of a shadowsocks server, only the plugins running in-process are accepted.
+func (s *proxyServer) setPlugin(plugin, opts string) error {
+	if plugin == "" {
+		return nil
+	}
+	options, err := self.ParsePluginOptions(opts)
+	if err != nil {
+		return newError("invalid options of plugin ", plugin).Base(err)
+	}
+	switch plugin {
+	case "obfs-local", "simple-obfs":
+		if mode, ok := options.Get("obfs"); ok && mode != "http" && mode != "tls" {
+			return newError("unsupported obfs mode: ", mode)
+		}
+		plugin = "obfs-local"
+	case "v2ray-plugin":
+		if mode, ok := options.Get("mode"); ok && mode != "websocket" && mode != "quic" && mode != "grpc" {
+			return newError("unsupported v2ray-plugin mode: ", mode)
+		}
+	default:
+		return newError("unsupported plugin: ", plugin)
+	}
+	s.Plugin = plugin
+	s.PluginOpts = opts
+	return nil
+}
+
+var pluginOptionEscaper = strings.NewReplacer(`\`, `\\`, `;`, `\;`, `=`, `\=`)
+
+// encodePluginOptions joins key value pairs in the format of SIP003 options, skipping empty values.
+// A value of "true" makes a bare key as used by flags like tls.
+func encodePluginOptions(pairs ...string) string {
+	var options []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		key, value := pairs[i], pairs[i+1]
+		switch value {
+		case "":
+		case "true":
+			options = append(options, key)
+		default:
+			options = append(options, key+"="+pluginOptionEscaper.Replace(value))
+		}
+	}
+	return strings.Join(options, ";")
+}
+
+type sip008Config struct {
+	Version int32          `json:"version"`
+	Servers []sip008Server `json:"servers"`
+}
+
+type sip008Server struct {
+	ID         string      `json:"id"`
+	Remarks    string      `json:"remarks"`
+	Server     string      `json:"server"`
+	ServerPort looseString `json:"server_port"`
+	Password   string      `json:"password"`
+	Method     string      `json:"method"`
+	Plugin     string      `json:"plugin"`
+	PluginOpts string      `json:"plugin_opts"`
+}
+
+func (server *sip008Server) proxyServer() (*proxyServer, error) {
+	s := &proxyServer{
+		Name:     server.Remarks,
+		Protocol: "shadowsocks",
+		Address:  server.Server,
+		Password: server.Password,
+		Method:   strings.ToLower(server.Method),
+	}
+	if s.Name == "" {
+		s.Name = server.ID
+	}
+	var err error
+	if s.Port, err = parsePort(string(server.ServerPort)); err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(s.Method, "2022-") {
+		s.Protocol = "shadowsocks2022"
+	}
+	if err = s.setPlugin(server.Plugin, server.PluginOpts); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ParseSIP008 converts a SIP008 online configuration into V2Ray v5 JSON outbounds,
+// with the remarks, or the id if empty, of each server as the tag.
+func ParseSIP008(content string) (*SubscriptionResult, error) {
+	var config sip008Config
+	if err := json.Unmarshal([]byte(content), &config); err != nil {
+		return nil, newError("failed to parse sip008 config").Base(err)
+	}
+	if config.Version != 1 {
+		return nil, newError("unsupported sip008 version: ", config.Version)
+	}
+	result := new(SubscriptionResult)
+	for index, server := range config.Servers {
+		s, err := server.proxyServer()
+		if err != nil {
+			entry := server.Remarks
+			if entry == "" {
+				entry = "servers[" + strconv.Itoa(index) + "]"
+			}
+			result.skip(entry, err)
+			continue
+		}
+		result.add(s)
+	}
+	return result.build()
+}
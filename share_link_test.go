@@ -0,0 +1,172 @@
+package libcore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/v2fly/v2ray-core/v5"
+)
+
+const testUUID = "b831381d-6324-4d53-ad4f-8cda48b30811"
+
+func TestShareLinkRoundTrip(t *testing.T) {
+	vmessJSON := `{"v":"2","ps":"v2rayN","add":"example.com","port":"443","id":"` + testUUID + `","aid":"0","net":"ws","type":"none","host":"cdn.example.com","path":"/ws","tls":"tls","sni":"example.com","fp":"chrome"}`
+	tests := []struct {
+		name string
+		link string
+		// contains are fragments expected in the outbound JSON.
+		contains []string
+	}{
+		{
+			name:     "vmess v2rayN",
+			link:     "vmess://" + base64.StdEncoding.EncodeToString([]byte(vmessJSON)),
+			contains: []string{`"protocol":"vmess"`, `"tag":"v2rayN"`, `"transport":"ws"`, `"security":"utls"`, `"imitate":"chrome_auto"`},
+		},
+		{
+			name:     "vmess shadowrocket",
+			link:     "vmess://" + base64.RawURLEncoding.EncodeToString([]byte("auto:"+testUUID+"@example.com:443")) + "?remarks=rocket&obfs=websocket&path=/ws&obfsParam=cdn.example.com&tls=1",
+			contains: []string{`"protocol":"vmess"`, `"tag":"rocket"`, `"transport":"ws"`, `"security":"tls"`},
+		},
+		{
+			name:     "vless tls",
+			link:     "vless://" + testUUID + "@example.com:443?type=tcp&security=tls&sni=example.com&alpn=h2,http/1.1#vless%20tls",
+			contains: []string{`"protocol":"vless"`, `"tag":"vless tls"`, `"security":"tls"`, `"nextProtocol":["h2","http/1.1"]`},
+		},
+		{
+			name:     "vless reality",
+			link:     "vless://" + testUUID + "@example.com:443?type=tcp&security=reality&sni=www.example.com&fp=firefox&pbk=AQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRobHB0eHyA&sid=6ba85179&spx=%2Fpath%3Fp%3D1-2#reality",
+			contains: []string{`"security":"reality"`, `"Fingerprint":"firefox"`, `"serverName":"www.example.com"`, `"spiderX":"/path"`, `"spiderY":[1,2,0,0,0,0,0,0,0,0]`},
+		},
+		{
+			name:     "vless ws",
+			link:     "vless://" + testUUID + "@example.com:443?type=ws&host=cdn.example.com&path=%2Fws%3Fed%3D2048&security=tls#ws",
+			contains: []string{`"transport":"ws"`, `"path":"/ws"`, `"maxEarlyData":2048`},
+		},
+		{
+			name:     "vless grpc reality",
+			link:     "vless://" + testUUID + "@example.com:443?type=grpc&serviceName=svc&security=reality&pbk=AQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRobHB0eHyA#grpc",
+			contains: []string{`"transport":"grpc"`, `"serviceName":"svc"`, `"security":"reality"`, `"Fingerprint":"chrome"`},
+		},
+		{
+			name:     "trojan",
+			link:     "trojan://password@example.com:443?sni=example.com#trojan",
+			contains: []string{`"protocol":"trojan"`, `"password":"password"`, `"security":"tls"`},
+		},
+		{
+			name:     "shadowsocks sip002",
+			link:     "ss://" + base64.RawURLEncoding.EncodeToString([]byte("aes-256-gcm:password")) + "@example.com:8388#ss",
+			contains: []string{`"protocol":"shadowsocks"`, `"method":"aes-256-gcm"`},
+		},
+		{
+			name:     "shadowsocks sip002 plugin",
+			link:     "ss://" + base64.RawURLEncoding.EncodeToString([]byte("chacha20-ietf-poly1305:password")) + "@example.com:8388/?plugin=obfs-local%3Bobfs%3Dhttp%3Bobfs-host%3Dexample.com#ss%20obfs",
+			contains: []string{`"plugin":"obfs-local"`, `"pluginOpts":"obfs=http;obfs-host=example.com"`},
+		},
+		{
+			name:     "shadowsocks 2022",
+			link:     "ss://2022-blake3-aes-128-gcm:" + base64.StdEncoding.EncodeToString(make([]byte, 16)) + "@example.com:8388#ss2022",
+			contains: []string{`"protocol":"shadowsocks2022"`, `"psk":"AAAAAAAAAAAAAAAAAAAAAA=="`},
+		},
+		{
+			name:     "shadowsocksr",
+			link:     "ssr://" + ssrBase64("example.com:8388:auth_aes128_md5:aes-256-cfb:tls1.2_ticket_auth:"+ssrBase64("password")+"/?obfsparam="+ssrBase64("cdn.example.com")+"&protoparam="+ssrBase64("1:key")+"&remarks="+ssrBase64("ssr")),
+			contains: []string{`"protocol":"shadowsocks"`, `"tag":"ssr"`, `"plugin":"shadowsocksr"`, `"--protocol=auth_aes128_md5"`, `"--protocol-param=1:key"`, `"--obfs=tls1.2_ticket_auth"`, `"--obfs-param=cdn.example.com"`},
+		},
+		{
+			name:     "shadowsocksr ipv6",
+			link:     "ssr://" + ssrBase64("2001:db8::1:8388:origin:aes-128-cfb:plain:"+ssrBase64("password")+"/?remarks="+ssrBase64("ssr v6")),
+			contains: []string{`"address":"2001:db8::1"`, `"port":8388`, `"--obfs=plain"`},
+		},
+		{
+			name:     "hysteria2",
+			link:     "hysteria2://password@example.com:443?sni=example.com&obfs=salamander&obfs-password=obfs#hy2",
+			contains: []string{`"transport":"hysteria2"`, `"password":"password"`, `"type":"salamander"`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outbound, err := ParseShareLink(test.link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, fragment := range test.contains {
+				if !strings.Contains(outbound, fragment) {
+					t.Errorf("%s not found in %s", fragment, outbound)
+				}
+			}
+			if _, err = core.LoadConfig(ConfigFormatJSONv5, bytes.NewReader([]byte(`{"outbounds":[`+outbound+`]}`))); err != nil {
+				t.Errorf("failed to load %s: %v", outbound, err)
+			}
+			link, err := ToShareLink(outbound)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := ParseShareLink(link)
+			if err != nil {
+				t.Fatalf("failed to parse %s: %v", link, err)
+			}
+			if again != outbound {
+				t.Errorf("round trip through %s\ngot  %s\nwant %s", link, again, outbound)
+			}
+		})
+	}
+}
+
+func ssrBase64(value string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+func TestShadowsocksRLinkDefaults(t *testing.T) {
+	// the protocol and obfs of outbounds without them are origin and plain in links
+	for _, pluginArgs := range []string{``, `,"pluginArgs":["--obfs="]`} {
+		outbound := `{"protocol":"shadowsocks","tag":"ssr","settings":{"address":"example.com","port":8388,"password":"password","method":"aes-256-cfb","plugin":"shadowsocksr"` + pluginArgs + `}}`
+		link, err := ToShareLink(outbound)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(link, "ssr://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "example.com:8388:origin:aes-256-cfb:plain:" + ssrBase64("password") + "/?"; !strings.HasPrefix(string(decoded), want) {
+			t.Errorf("%s: got %s, want %s", outbound, decoded, want)
+		}
+		parsed, err := ParseShareLink(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(parsed, `"--protocol=origin"`) || !strings.Contains(parsed, `"--obfs=plain"`) {
+			t.Errorf("%s parsed as %s", link, parsed)
+		}
+	}
+}
+
+func TestShareLinkMalformed(t *testing.T) {
+	links := []string{
+		"",
+		"http://example.com",
+		"vmess://not base64",
+		"vmess://" + base64.StdEncoding.EncodeToString([]byte(`{"add":"example.com","port":"443"}`)),
+		"vless://" + testUUID + "@example.com",
+		"vless://" + testUUID + "@example.com:0",
+		"vless://" + testUUID + "@example.com:443?type=tcp&headerType=http",
+		"vless://" + testUUID + "@example.com:443?security=reality",
+		"vless://" + testUUID + "@example.com:443?security=reality&pbk=AQID",
+		"vless://" + testUUID + "@example.com:443?security=reality&pbk=AQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRobHB0eHyA&sid=xyz",
+		"vless://" + testUUID + "@example.com:443?security=reality&pbk=AQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRobHB0eHyA&fp=unknown",
+		"trojan://example.com:443",
+		"ss://" + base64.RawURLEncoding.EncodeToString([]byte("aes-256-gcm")) + "@example.com:8388",
+		"hysteria2://password@example.com:99999",
+		"ssr://not base64",
+		"ssr://" + ssrBase64("example.com:8388:origin:aes-256-cfb:plain"),
+		"ssr://" + ssrBase64("example.com:0:origin:aes-256-cfb:plain:"+ssrBase64("password")),
+		"ssr://" + ssrBase64("example.com:8388:origin:aes-256-cfb:plain:!!"),
+	}
+	for _, link := range links {
+		if outbound, err := ParseShareLink(link); err == nil {
+			t.Errorf("%q parsed as %s", link, outbound)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package stun
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+const (
+	defaultRetransmissions = 3
+	defaultTimeout         = time.Second
+)
+
+// lifetimeProbes are the idle times probed one after another, so the estimation takes their sum.
+var lifetimeProbes = []time.Duration{
+	5 * time.Second,
+	15 * time.Second,
+	30 * time.Second,
+	60 * time.Second,
+	120 * time.Second,
+	300 * time.Second,
+}
+
+// Behavior is the result of the RFC 5780 NAT behavior discovery.
+type Behavior struct {
+	MappingType   stun.BehaviorType
+	FilteringType stun.BehaviorType
+
+	// MappedAddress is the mapping observed by the primary address, the other ones
+	// are observed by the alternate IP and by the alternate IP and port.
+	MappedAddress          *net.UDPAddr
+	MappedAddressOtherIP   *net.UDPAddr
+	MappedAddressOtherAddr *net.UDPAddr
+
+	// NoNAT is set if the mapped address is the local address, the client is not behind a NAT.
+	NoNAT bool
+
+	Hairpinning bool
+
+	// BindingLifetime is the longest idle time the mapping was observed to survive,
+	// zero if the test is skipped or no probe succeeded.
+	BindingLifetime time.Duration
+}
+
+func (b *Behavior) NormalType() string {
+	return stun.NATBehavior{MappingType: b.MappingType, FilteringType: b.FilteringType}.NormalType()
+}
+
+type behaviorClient struct {
+	conn    net.PacketConn
+	timeout time.Duration
+}
+
+func (c *behaviorClient) request(addr *net.UDPAddr, change uint32) (*message, error) {
+	request := &message{
+		messageType:   typeBindingRequest,
+		transactionID: newTransactionID(),
+		changeRequest: change,
+	}
+	packet := request.encode()
+	buffer := make([]byte, 1500)
+	for i := 0; i < defaultRetransmissions; i++ {
+		if _, err := c.conn.WriteTo(packet, addr); err != nil {
+			return nil, err
+		}
+		err := c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		if err != nil {
+			return nil, err
+		}
+		for {
+			n, _, err := c.conn.ReadFrom(buffer)
+			if err != nil {
+				if isTimeout(err) {
+					break
+				}
+				return nil, err
+			}
+			response, err := decodeMessage(buffer[:n])
+			if err != nil || response.transactionID != request.transactionID {
+				continue
+			}
+			if response.messageType != typeBindingResponse {
+				return nil, newError("unexpected message type ", response.messageType)
+			}
+			if response.mappedAddress == nil {
+				return nil, newError("no mapped address in response")
+			}
+			return response, nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *behaviorClient) hairpinning(mappedAddress *net.UDPAddr) (bool, error) {
+	request := &message{
+		messageType:   typeBindingRequest,
+		transactionID: newTransactionID(),
+	}
+	packet := request.encode()
+	buffer := make([]byte, 1500)
+	if _, err := c.conn.WriteTo(packet, mappedAddress); err != nil {
+		return false, err
+	}
+	if err := c.conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return false, err
+	}
+	for {
+		n, _, err := c.conn.ReadFrom(buffer)
+		if err != nil {
+			if isTimeout(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		if bytes.Equal(buffer[:n], packet) {
+			return true, nil
+		}
+	}
+}
+
+// bindingLifetime probes increasing idle times while their total stays within max.
+// Each probe refreshes the mapping, the first one is refreshed by a request made right before.
+func (c *behaviorClient) bindingLifetime(addr *net.UDPAddr, max time.Duration) (time.Duration, error) {
+	var lifetime, idle time.Duration
+	response, err := c.request(addr, 0)
+	if err != nil || response == nil {
+		return 0, err
+	}
+	mappedAddress := response.mappedAddress
+	for _, probe := range lifetimeProbes {
+		if idle+probe > max {
+			break
+		}
+		idle += probe
+		time.Sleep(probe)
+		response, err = c.request(addr, 0)
+		if err != nil {
+			return lifetime, err
+		}
+		if response == nil || !equalAddr(response.mappedAddress, mappedAddress) {
+			break
+		}
+		lifetime = probe
+	}
+	return lifetime, nil
+}
+
+// isTimeout reports read deadlines of any packet connection, including proxied ones.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func equalAddr(a, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
+
+// behaviorTest runs the filtering tests on filteringConn, a connection without permissions opened by the mapping tests.
+func behaviorTest(conn net.PacketConn, filteringConn net.PacketConn, addr *net.UDPAddr, options *Options) (*Behavior, error) {
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	c := &behaviorClient{conn: conn, timeout: timeout}
+	filtering := &behaviorClient{conn: filteringConn, timeout: timeout}
+	behavior := new(Behavior)
+
+	// Test I: (IP1, port1)
+	response1, err := c.request(addr, 0)
+	if err != nil {
+		return nil, err
+	}
+	if response1 == nil {
+		return nil, newError("NAT blocked")
+	}
+	behavior.MappedAddress = response1.mappedAddress
+	if local, ok := conn.LocalAddr().(*net.UDPAddr); ok && equalAddr(local, response1.mappedAddress) {
+		behavior.NoNAT = true
+	}
+	otherAddress := response1.otherAddress
+	if otherAddress == nil {
+		return nil, newError("server error: no other address")
+	}
+
+	// Test II: (IP2, port1)
+	response2, err := c.request(&net.UDPAddr{IP: otherAddress.IP, Port: addr.Port}, 0)
+	if err != nil {
+		return nil, err
+	}
+	if response2 == nil {
+		return nil, newError("no response from alternate address ", otherAddress.IP)
+	}
+	behavior.MappedAddressOtherIP = response2.mappedAddress
+	if equalAddr(response2.mappedAddress, response1.mappedAddress) {
+		behavior.MappingType = stun.BehaviorTypeEndpoint
+	} else {
+		// Test III: (IP2, port2)
+		response3, err := c.request(otherAddress, 0)
+		if err != nil {
+			return nil, err
+		}
+		if response3 == nil {
+			return nil, newError("no response from alternate address ", otherAddress)
+		}
+		behavior.MappedAddressOtherAddr = response3.mappedAddress
+		if equalAddr(response3.mappedAddress, response2.mappedAddress) {
+			behavior.MappingType = stun.BehaviorTypeAddr
+		} else {
+			behavior.MappingType = stun.BehaviorTypeAddrAndPort
+		}
+	}
+
+	// Filtering test II: ask for a response from (IP2, port2)
+	response, err := filtering.request(addr, changeIP|changePort)
+	if err != nil {
+		return behavior, err
+	}
+	if response != nil {
+		behavior.FilteringType = stun.BehaviorTypeEndpoint
+	} else {
+		// Filtering test III: ask for a response from (IP1, port2)
+		response, err = filtering.request(addr, changePort)
+		if err != nil {
+			return behavior, err
+		}
+		if response != nil {
+			behavior.FilteringType = stun.BehaviorTypeAddr
+		} else {
+			behavior.FilteringType = stun.BehaviorTypeAddrAndPort
+		}
+	}
+
+	behavior.Hairpinning, err = c.hairpinning(behavior.MappedAddress)
+	if err != nil {
+		return behavior, err
+	}
+
+	if options.BindingLifetimeMax > 0 {
+		behavior.BindingLifetime, err = c.bindingLifetime(addr, options.BindingLifetimeMax)
+		if err != nil {
+			return behavior, err
+		}
+	}
+
+	return behavior, nil
+}
@@ -0,0 +1,121 @@
+package stun
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+func listenTestServer(t *testing.T) *Server {
+	server, err := ListenServer("127.0.0.1", "127.0.0.2")
+	if err != nil {
+		t.Skip("loopback alias unavailable: ", err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+	return server
+}
+
+func TestBehaviorSimulatedNAT(t *testing.T) {
+	server := listenTestServer(t)
+	behaviors := []stun.BehaviorType{
+		stun.BehaviorTypeEndpoint,
+		stun.BehaviorTypeAddr,
+		stun.BehaviorTypeAddrAndPort,
+	}
+	for _, mapping := range behaviors {
+		for _, filtering := range behaviors {
+			mapping, filtering := mapping, filtering
+			hairpinning := mapping == filtering
+			t.Run(mapping.String()+"/"+filtering.String(), func(t *testing.T) {
+				t.Parallel()
+				nat := &SimulatedNAT{
+					ListenIP:    "127.0.0.1",
+					Mapping:     mapping,
+					Filtering:   filtering,
+					Hairpinning: hairpinning,
+				}
+				behavior, err := TestWithOptions(server.Addr(), &Options{
+					ListenPacket: nat.ListenPacket,
+					Timeout:      200 * time.Millisecond,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if behavior.MappingType != mapping {
+					t.Errorf("mapping: got %s, want %s", behavior.MappingType, mapping)
+				}
+				if behavior.FilteringType != filtering {
+					t.Errorf("filtering: got %s, want %s", behavior.FilteringType, filtering)
+				}
+				if behavior.Hairpinning != hairpinning {
+					t.Errorf("hairpinning: got %v, want %v", behavior.Hairpinning, hairpinning)
+				}
+				if behavior.NoNAT {
+					t.Error("simulated NAT reported as no NAT")
+				}
+				if behavior.MappedAddress == nil || behavior.MappedAddressOtherIP == nil {
+					t.Error("missing mapped addresses")
+				}
+				if (mapping == stun.BehaviorTypeEndpoint) != (behavior.MappedAddressOtherAddr == nil) {
+					t.Errorf("mapped address of test III: %v", behavior.MappedAddressOtherAddr)
+				}
+			})
+		}
+	}
+}
+
+func TestBehaviorNoNAT(t *testing.T) {
+	server := listenTestServer(t)
+	behavior, err := TestWithOptions(server.Addr(), &Options{
+		ListenPacket: func(string) (net.PacketConn, error) {
+			return net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		},
+		Timeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !behavior.NoNAT {
+		t.Error("no NAT not detected")
+	}
+	if behavior.MappingType != stun.BehaviorTypeEndpoint || behavior.FilteringType != stun.BehaviorTypeEndpoint {
+		t.Errorf("got %s mapping and %s filtering", behavior.MappingType, behavior.FilteringType)
+	}
+}
+
+func TestBehaviorBindingLifetime(t *testing.T) {
+	server := listenTestServer(t)
+	probes := lifetimeProbes
+	lifetimeProbes = []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}
+	t.Cleanup(func() { lifetimeProbes = probes })
+	tests := []struct {
+		max      time.Duration
+		lifetime time.Duration
+	}{
+		{time.Second, 100 * time.Millisecond},
+		// the 100ms probe would exceed the total idle time
+		{100 * time.Millisecond, 50 * time.Millisecond},
+		{10 * time.Millisecond, 0},
+	}
+	for _, test := range tests {
+		nat := &SimulatedNAT{
+			ListenIP:        "127.0.0.1",
+			Mapping:         stun.BehaviorTypeEndpoint,
+			Filtering:       stun.BehaviorTypeEndpoint,
+			BindingLifetime: 150 * time.Millisecond,
+		}
+		behavior, err := TestWithOptions(server.Addr(), &Options{
+			ListenPacket:       nat.ListenPacket,
+			BindingLifetimeMax: test.max,
+			Timeout:            200 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if behavior.BindingLifetime != test.lifetime {
+			t.Errorf("max %s: got lifetime %s, want %s", test.max, behavior.BindingLifetime, test.lifetime)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package stun
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+)
+
+const (
+	magicCookie = 0x2112A442
+
+	typeBindingRequest  = 0x0001
+	typeBindingResponse = 0x0101
+
+	attributeMappedAddress    = 0x0001
+	attributeChangeRequest    = 0x0003
+	attributeSourceAddress    = 0x0004
+	attributeChangedAddress   = 0x0005
+	attributeXorMappedAddress = 0x0020
+	attributeXorMappedOld     = 0x8020
+	attributeResponseOrigin   = 0x802b
+	attributeOtherAddress     = 0x802c
+
+	changeIP   = 0x04
+	changePort = 0x02
+
+	headerSize = 20
+)
+
+type transactionID [12]byte
+
+func newTransactionID() (id transactionID) {
+	_, _ = rand.Read(id[:])
+	return
+}
+
+type message struct {
+	messageType   uint16
+	transactionID transactionID
+
+	changeRequest uint32
+
+	mappedAddress  *net.UDPAddr
+	responseOrigin *net.UDPAddr
+	otherAddress   *net.UDPAddr
+}
+
+func (m *message) encode() []byte {
+	b := make([]byte, headerSize, headerSize+8*4+12*4)
+	if m.changeRequest != 0 {
+		b = appendAttribute(b, attributeChangeRequest, binary.BigEndian.AppendUint32(nil, m.changeRequest))
+	}
+	if m.mappedAddress != nil {
+		b = appendAttribute(b, attributeXorMappedAddress, encodeAddress(m.mappedAddress, &m.transactionID, true))
+		b = appendAttribute(b, attributeMappedAddress, encodeAddress(m.mappedAddress, &m.transactionID, false))
+	}
+	if m.responseOrigin != nil {
+		b = appendAttribute(b, attributeResponseOrigin, encodeAddress(m.responseOrigin, &m.transactionID, false))
+	}
+	if m.otherAddress != nil {
+		b = appendAttribute(b, attributeOtherAddress, encodeAddress(m.otherAddress, &m.transactionID, false))
+	}
+	binary.BigEndian.PutUint16(b[0:], m.messageType)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)-headerSize))
+	binary.BigEndian.PutUint32(b[4:], magicCookie)
+	copy(b[8:], m.transactionID[:])
+	return b
+}
+
+func appendAttribute(b []byte, attributeType uint16, value []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, attributeType)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func encodeAddress(addr *net.UDPAddr, id *transactionID, xor bool) []byte {
+	ip := addr.IP.To4()
+	family := byte(0x01)
+	if ip == nil {
+		ip = addr.IP.To16()
+		family = 0x02
+	}
+	b := make([]byte, 4+len(ip))
+	b[1] = family
+	binary.BigEndian.PutUint16(b[2:], uint16(addr.Port))
+	copy(b[4:], ip)
+	if xor {
+		xorAddress(b, id)
+	}
+	return b
+}
+
+func xorAddress(b []byte, id *transactionID) {
+	var key [16]byte
+	binary.BigEndian.PutUint32(key[:], magicCookie)
+	copy(key[4:], id[:])
+	b[2] ^= key[0]
+	b[3] ^= key[1]
+	for i := 4; i < len(b); i++ {
+		b[i] ^= key[i-4]
+	}
+}
+
+func decodeAddress(value []byte, id *transactionID, xor bool) *net.UDPAddr {
+	if len(value) < 8 {
+		return nil
+	}
+	var size int
+	switch value[1] {
+	case 0x01:
+		size = net.IPv4len
+	case 0x02:
+		size = net.IPv6len
+	default:
+		return nil
+	}
+	if len(value) < 4+size {
+		return nil
+	}
+	b := make([]byte, 4+size)
+	copy(b, value)
+	if xor {
+		xorAddress(b, id)
+	}
+	return &net.UDPAddr{
+		IP:   net.IP(b[4:]),
+		Port: int(binary.BigEndian.Uint16(b[2:])),
+	}
+}
+
+func decodeMessage(b []byte) (*message, error) {
+	if len(b) < headerSize {
+		return nil, newError("message too short")
+	}
+	if binary.BigEndian.Uint32(b[4:]) != magicCookie {
+		return nil, newError("bad magic cookie")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if headerSize+length > len(b) {
+		return nil, newError("truncated message")
+	}
+	m := &message{messageType: binary.BigEndian.Uint16(b[0:])}
+	copy(m.transactionID[:], b[8:headerSize])
+
+	var mappedAddress, xorMappedAddress *net.UDPAddr
+	attributes := b[headerSize : headerSize+length]
+	for len(attributes) >= 4 {
+		attributeType := binary.BigEndian.Uint16(attributes[0:])
+		attributeLength := int(binary.BigEndian.Uint16(attributes[2:]))
+		if 4+attributeLength > len(attributes) {
+			return nil, newError("truncated attribute ", attributeType)
+		}
+		value := attributes[4 : 4+attributeLength]
+		switch attributeType {
+		case attributeChangeRequest:
+			if len(value) == 4 {
+				m.changeRequest = binary.BigEndian.Uint32(value)
+			}
+		case attributeMappedAddress:
+			mappedAddress = decodeAddress(value, &m.transactionID, false)
+		case attributeXorMappedAddress, attributeXorMappedOld:
+			xorMappedAddress = decodeAddress(value, &m.transactionID, true)
+		case attributeResponseOrigin, attributeSourceAddress:
+			m.responseOrigin = decodeAddress(value, &m.transactionID, false)
+		case attributeOtherAddress, attributeChangedAddress:
+			m.otherAddress = decodeAddress(value, &m.transactionID, false)
+		}
+		padded := (4 + attributeLength + 3) &^ 3
+		if padded > len(attributes) {
+			break
+		}
+		attributes = attributes[padded:]
+	}
+	if xorMappedAddress != nil {
+		m.mappedAddress = xorMappedAddress
+	} else {
+		m.mappedAddress = mappedAddress
+	}
+	return m, nil
+}
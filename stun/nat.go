@@ -0,0 +1,202 @@
+package stun
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ccding/go-stun/stun"
+)
+
+// SimulatedNAT creates packet connections which behave like a client behind a NAT
+// with the given mapping and filtering behavior. Each mapping is backed by a real
+// UDP socket on ListenIP, so it can be used together with Server on loopback.
+type SimulatedNAT struct {
+	ListenIP        string
+	Mapping         stun.BehaviorType
+	Filtering       stun.BehaviorType
+	Hairpinning     bool
+	BindingLifetime time.Duration
+}
+
+var _ PacketConnFactory = (*SimulatedNAT)(nil).ListenPacket
+
+// ListenPacket implements PacketConnFactory.
+func (n *SimulatedNAT) ListenPacket(string) (net.PacketConn, error) {
+	c := &natConn{
+		nat:      n,
+		mappings: make(map[string]*natMapping),
+		packets:  make(chan natPacket, 64),
+		done:     make(chan struct{}),
+		local:    &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 40000},
+	}
+	return c, nil
+}
+
+type natPacket struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+type natMapping struct {
+	conn       *net.UDPConn
+	lastActive time.Time
+	// peers the mapping has sent to, keyed by ip or ip:port according to the filtering behavior
+	permissions map[string]bool
+}
+
+type natConn struct {
+	nat *SimulatedNAT
+
+	access   sync.Mutex
+	mappings map[string]*natMapping
+
+	packets  chan natPacket
+	done     chan struct{}
+	closed   bool
+	local    *net.UDPAddr
+	deadline time.Time
+}
+
+func behaviorKey(behavior stun.BehaviorType, addr *net.UDPAddr) string {
+	switch behavior {
+	case stun.BehaviorTypeAddr:
+		return addr.IP.String()
+	case stun.BehaviorTypeAddrAndPort:
+		return addr.String()
+	default:
+		return ""
+	}
+}
+
+func (c *natConn) mapping(addr *net.UDPAddr) (*natMapping, error) {
+	key := behaviorKey(c.nat.Mapping, addr)
+	m := c.mappings[key]
+	if m != nil && c.nat.BindingLifetime > 0 && time.Since(m.lastActive) > c.nat.BindingLifetime {
+		_ = m.conn.Close()
+		m = nil
+	}
+	if m == nil {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(c.nat.ListenIP)})
+		if err != nil {
+			return nil, err
+		}
+		m = &natMapping{conn: conn, permissions: make(map[string]bool)}
+		c.mappings[key] = m
+		go c.loop(m)
+	}
+	m.lastActive = time.Now()
+	return m, nil
+}
+
+func (c *natConn) loop(m *natMapping) {
+	buffer := make([]byte, 1500)
+	for {
+		n, from, err := m.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		c.access.Lock()
+		expired := c.nat.BindingLifetime > 0 && time.Since(m.lastActive) > c.nat.BindingLifetime
+		allowed := c.nat.Filtering == stun.BehaviorTypeEndpoint || m.permissions[behaviorKey(c.nat.Filtering, from)]
+		c.access.Unlock()
+		if expired || !allowed {
+			continue
+		}
+		c.deliver(append([]byte(nil), buffer[:n]...), from)
+	}
+}
+
+// deliver queues data, which must not be reused by the caller.
+func (c *natConn) deliver(data []byte, from *net.UDPAddr) {
+	packet := natPacket{data: data, from: from}
+	select {
+	case c.packets <- packet:
+	case <-c.done:
+	default:
+	}
+}
+
+func (c *natConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.access.Lock()
+	deadline := c.deadline
+	c.access.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case packet := <-c.packets:
+		return copy(p, packet.data), packet.from, nil
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *natConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, newError("unsupported address ", addr)
+	}
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	for _, m := range c.mappings {
+		if equalAddr(m.conn.LocalAddr().(*net.UDPAddr), udpAddr) {
+			source, err := c.mapping(udpAddr)
+			if err != nil {
+				return 0, err
+			}
+			if c.nat.Hairpinning {
+				go c.deliver(append([]byte(nil), p...), source.conn.LocalAddr().(*net.UDPAddr))
+			}
+			return len(p), nil
+		}
+	}
+	m, err := c.mapping(udpAddr)
+	if err != nil {
+		return 0, err
+	}
+	m.permissions[behaviorKey(c.nat.Filtering, udpAddr)] = true
+	return m.conn.WriteTo(p, udpAddr)
+}
+
+func (c *natConn) Close() error {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	for _, m := range c.mappings {
+		_ = m.conn.Close()
+	}
+	return nil
+}
+
+func (c *natConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *natConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *natConn) SetReadDeadline(t time.Time) error {
+	c.access.Lock()
+	c.deadline = t
+	c.access.Unlock()
+	return nil
+}
+
+func (c *natConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
@@ -0,0 +1,115 @@
+package stun
+
+import (
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Server is a minimal RFC 5780 capable STUN server, listening on two IPs and two ports.
+// It is used as a local stand-in for a public server.
+type Server struct {
+	conns [2][2]net.PacketConn
+	addrs [2][2]*net.UDPAddr
+	wg    sync.WaitGroup
+}
+
+// ListenServer starts a server on primaryIP and alternateIP, both ports are chosen by the system.
+func ListenServer(primaryIP, alternateIP string) (*Server, error) {
+	ips := [2]net.IP{net.ParseIP(primaryIP), net.ParseIP(alternateIP)}
+	if ips[0] == nil || ips[1] == nil {
+		return nil, newError("invalid server ip: ", primaryIP, ", ", alternateIP)
+	}
+	s := new(Server)
+	var err error
+	for retry := 0; retry < 16; retry++ {
+		err = s.listen(ips)
+		if err == nil {
+			break
+		}
+		s.closeConns()
+		s.conns = [2][2]net.PacketConn{}
+	}
+	if err != nil {
+		return nil, newError("failed to listen stun server").Base(err)
+	}
+	for i := range s.conns {
+		for j := range s.conns[i] {
+			s.wg.Add(1)
+			go s.serve(i, j)
+		}
+	}
+	return s, nil
+}
+
+func (s *Server) listen(ips [2]net.IP) error {
+	var ports [2]int
+	for j := range ports {
+		for i := range ips {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ips[i], Port: ports[j]})
+			if err != nil {
+				return err
+			}
+			s.conns[i][j] = conn
+			s.addrs[i][j] = conn.LocalAddr().(*net.UDPAddr)
+			ports[j] = s.addrs[i][j].Port
+		}
+	}
+	return nil
+}
+
+func (s *Server) serve(i, j int) {
+	defer s.wg.Done()
+	conn := s.conns[i][j]
+	buffer := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		request, err := decodeMessage(buffer[:n])
+		if err != nil || request.messageType != typeBindingRequest {
+			continue
+		}
+		source, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		ri, rj := i, j
+		if request.changeRequest&changeIP != 0 {
+			ri = 1 - ri
+		}
+		if request.changeRequest&changePort != 0 {
+			rj = 1 - rj
+		}
+		response := &message{
+			messageType:    typeBindingResponse,
+			transactionID:  request.transactionID,
+			mappedAddress:  source,
+			responseOrigin: s.addrs[ri][rj],
+			otherAddress:   s.addrs[1-i][1-j],
+		}
+		_, _ = s.conns[ri][rj].WriteTo(response.encode(), source)
+	}
+}
+
+// Addr returns the primary address of the server.
+func (s *Server) Addr() string {
+	return net.JoinHostPort(s.addrs[0][0].IP.String(), strconv.Itoa(s.addrs[0][0].Port))
+}
+
+func (s *Server) closeConns() {
+	for i := range s.conns {
+		for j := range s.conns[i] {
+			if s.conns[i][j] != nil {
+				_ = s.conns[i][j].Close()
+			}
+		}
+	}
+}
+
+func (s *Server) Close() error {
+	s.closeConns()
+	s.wg.Wait()
+	return nil
+}
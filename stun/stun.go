@@ -4,11 +4,33 @@ import (
 	"context"
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/ccding/go-stun/stun"
 	"github.com/wzshiming/socks5"
 )
 
+//go:generate go run ../errorgen
+
+var DefaultServerAddress = "stun.syncthing.net:3478"
+
+// PacketConnFactory creates the packet connection used to reach the STUN server at addrStr.
+type PacketConnFactory func(addrStr string) (net.PacketConn, error)
+
+// Resolver resolves the STUN server host when the packet connection can not do it itself.
+type Resolver func(host string) (net.IP, error)
+
+type Options struct {
+	ListenPacket PacketConnFactory
+	Resolve      Resolver
+
+	// BindingLifetimeMax enables the binding lifetime estimation, probing idle times that add up to at most it.
+	BindingLifetimeMax time.Duration
+
+	// Timeout is the time to wait for each response, one second if zero.
+	Timeout time.Duration
+}
+
 func setupPacketConn(useSOCKS5 bool, addrStr string, socksPort int) (net.PacketConn, error) {
 	if useSOCKS5 {
 		dialer, _ := socks5.NewDialer("socks5h://127.0.0.1:" + strconv.Itoa(socksPort))
@@ -37,53 +59,93 @@ func resolveDNS(host string, dnsPort int) (net.IP, error) {
 	return ips[0], nil
 }
 
-// RFC 5780
-func Test(addrStr string, useSOCKS5 bool, socksPort int, dnsPort int) (*stun.NATBehavior, error) {
-	if addrStr == "" {
-		addrStr = "stun.syncthing.net:3478"
-	}
-	host, port, err := net.SplitHostPort(addrStr)
-	if err != nil {
-		return nil, err
-	}
-	packetConn, err := setupPacketConn(useSOCKS5, addrStr, socksPort)
-	if err != nil {
-		return nil, err
+func socksOptions(useSOCKS5 bool, socksPort int, dnsPort int) *Options {
+	options := &Options{
+		ListenPacket: func(addrStr string) (net.PacketConn, error) {
+			return setupPacketConn(useSOCKS5, addrStr, socksPort)
+		},
 	}
-	if useSOCKS5 && net.ParseIP(host) == nil {
-		ip, err := resolveDNS(host, dnsPort)
-		if err != nil {
-			return nil, err
+	if useSOCKS5 {
+		options.Resolve = func(host string) (net.IP, error) {
+			return resolveDNS(host, dnsPort)
 		}
-		addrStr = net.JoinHostPort(ip.String(), port)
 	}
-	client := stun.NewClientWithConnection(packetConn)
-	client.SetServerAddr(addrStr)
-	return client.BehaviorTest()
+	return options
 }
 
-// RFC 3489
-func TestLegacy(addrStr string, useSOCKS5 bool, socksPort int, dnsPort int) (*stun.NATType, *stun.Host, error) {
+func (o *Options) setup(addrStr string) (net.PacketConn, *net.UDPAddr, error) {
 	if addrStr == "" {
-		addrStr = "stun.syncthing.net:3478"
+		addrStr = DefaultServerAddress
 	}
 	host, port, err := net.SplitHostPort(addrStr)
 	if err != nil {
 		return nil, nil, err
 	}
-	packetConn, err := setupPacketConn(useSOCKS5, addrStr, socksPort)
+	listen := o.ListenPacket
+	if listen == nil {
+		listen = func(string) (net.PacketConn, error) {
+			return net.ListenUDP("udp", nil)
+		}
+	}
+	packetConn, err := listen(addrStr)
 	if err != nil {
 		return nil, nil, err
 	}
-	if useSOCKS5 && net.ParseIP(host) == nil {
-		ip, err := resolveDNS(host, dnsPort)
+	if o.Resolve != nil && net.ParseIP(host) == nil {
+		ip, err := o.Resolve(host)
 		if err != nil {
+			packetConn.Close()
 			return nil, nil, err
 		}
 		addrStr = net.JoinHostPort(ip.String(), port)
 	}
+	addr, err := net.ResolveUDPAddr("udp", addrStr)
+	if err != nil {
+		packetConn.Close()
+		return nil, nil, err
+	}
+	return packetConn, addr, nil
+}
+
+// RFC 5780
+func Test(addrStr string, useSOCKS5 bool, socksPort int, dnsPort int) (*Behavior, error) {
+	return TestWithBindingLifetime(addrStr, useSOCKS5, socksPort, dnsPort, 0)
+}
+
+// TestWithBindingLifetime is Test with the binding lifetime estimation, which waits up to bindingLifetimeMax in total.
+func TestWithBindingLifetime(addrStr string, useSOCKS5 bool, socksPort int, dnsPort int, bindingLifetimeMax time.Duration) (*Behavior, error) {
+	options := socksOptions(useSOCKS5, socksPort, dnsPort)
+	options.BindingLifetimeMax = bindingLifetimeMax
+	return TestWithOptions(addrStr, options)
+}
+
+func TestWithOptions(addrStr string, options *Options) (*Behavior, error) {
+	packetConn, addr, err := options.setup(addrStr)
+	if err != nil {
+		return nil, err
+	}
+	defer packetConn.Close()
+	filteringConn, _, err := options.setup(addrStr)
+	if err != nil {
+		return nil, err
+	}
+	defer filteringConn.Close()
+	return behaviorTest(packetConn, filteringConn, addr, options)
+}
+
+// RFC 3489
+func TestLegacy(addrStr string, useSOCKS5 bool, socksPort int, dnsPort int) (*stun.NATType, *stun.Host, error) {
+	return TestLegacyWithOptions(addrStr, socksOptions(useSOCKS5, socksPort, dnsPort))
+}
+
+func TestLegacyWithOptions(addrStr string, options *Options) (*stun.NATType, *stun.Host, error) {
+	packetConn, addr, err := options.setup(addrStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer packetConn.Close()
 	client := stun.NewClientWithConnection(packetConn)
-	client.SetServerAddr(addrStr)
-	natType, addr, err := client.Discover()
-	return &natType, addr, err
+	client.SetServerAddr(addr.String())
+	natType, host, err := client.Discover()
+	return &natType, host, err
 }
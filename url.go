@@ -6,6 +6,8 @@ import (
 	"strconv"
 	"strings"
 	_ "unsafe"
+
+	"golang.org/x/net/idna"
 )
 
 type URL interface {
@@ -19,6 +21,10 @@ type URL interface {
 	SetPassword(password string) error
 	GetHost() string
 	SetHost(host string)
+	// GetASCIIHost returns the host with internationalized domain names converted to punycode.
+	GetASCIIHost() (string, error)
+	// GetUnicodeHost returns the host with punycode labels converted to unicode.
+	GetUnicodeHost() string
 	GetPort() int32
 	SetPort(port int32)
 	GetPath() string
@@ -26,7 +32,13 @@ type URL interface {
 	GetRawPath() string
 	SetRawPath(rawPath string) error
 	QueryParameterNotBlank(key string) string
+	// GetQueryParameterKeys returns the distinct keys in their original order, separated by newlines.
+	GetQueryParameterKeys() string
+	// GetQueryParameterValues returns all values of the key, separated by newlines.
+	GetQueryParameterValues(key string) string
 	AddQueryParameter(key, value string)
+	// SetQueryParameter replaces the values of the key in place, or adds it if not present.
+	SetQueryParameter(key, value string)
 	DeleteQueryParameter(key string)
 	GetFragment() string
 	SetRawFragment(rawFragment string) error
@@ -37,16 +49,117 @@ var _ URL = (*netURL)(nil)
 
 type netURL struct {
 	url.URL
-	url.Values
+	queryValues
 }
 
 func NewURL(scheme string) URL {
 	u := new(netURL)
 	u.Scheme = scheme
-	u.Values = make(url.Values)
 	return u
 }
 
+type queryParameter struct {
+	key   string
+	value string
+}
+
+// queryValues is url.Values that keeps the order of parameters.
+type queryValues []queryParameter
+
+// parseQueryValues is url.ParseQuery which keeps the order and unescaped semicolons in values,
+// as in plugin=obfs-local;obfs=http of many share links.
+func parseQueryValues(rawQuery string) queryValues {
+	var query queryValues
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		if unescaped, err := url.QueryUnescape(value); err == nil {
+			value = unescaped
+		}
+		query = append(query, queryParameter{key, value})
+	}
+	return query
+}
+
+func (q queryValues) Get(key string) string {
+	for _, parameter := range q {
+		if parameter.key == key {
+			return parameter.value
+		}
+	}
+	return ""
+}
+
+func (q queryValues) Keys() []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, parameter := range q {
+		if !seen[parameter.key] {
+			seen[parameter.key] = true
+			keys = append(keys, parameter.key)
+		}
+	}
+	return keys
+}
+
+func (q queryValues) Values(key string) []string {
+	var values []string
+	for _, parameter := range q {
+		if parameter.key == key {
+			values = append(values, parameter.value)
+		}
+	}
+	return values
+}
+
+func (q *queryValues) Add(key, value string) {
+	*q = append(*q, queryParameter{key, value})
+}
+
+func (q *queryValues) Set(key, value string) {
+	index := -1
+	for i, parameter := range *q {
+		if parameter.key == key {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		q.Add(key, value)
+		return
+	}
+	q.Del(key)
+	*q = append((*q)[:index], append(queryValues{{key, value}}, (*q)[index:]...)...)
+}
+
+func (q *queryValues) Del(key string) {
+	query := (*q)[:0]
+	for _, parameter := range *q {
+		if parameter.key != key {
+			query = append(query, parameter)
+		}
+	}
+	*q = query
+}
+
+func (q queryValues) Encode() string {
+	var builder strings.Builder
+	for i, parameter := range q {
+		if i > 0 {
+			builder.WriteByte('&')
+		}
+		builder.WriteString(url.QueryEscape(parameter.key))
+		builder.WriteByte('=')
+		builder.WriteString(url.QueryEscape(parameter.value))
+	}
+	return builder.String()
+}
+
 //go:linkname setFragment net/url.(*URL).setFragment
 func setFragment(u *url.URL, fragment string) error
 
@@ -61,10 +174,7 @@ func ParseURL(rawURL string) (URL, error) {
 		return nil, newError("failed to parse url: ", rawURL).Base(err)
 	}
 	u.URL = *uu
-	u.Values = u.Query()
-	if u.Values == nil {
-		u.Values = make(url.Values)
-	}
+	u.queryValues = parseQueryValues(uu.RawQuery)
 	if frag == "" {
 		return u, nil
 	}
@@ -130,6 +240,19 @@ func (u *netURL) GetHost() string {
 	return u.Hostname()
 }
 
+func (u *netURL) GetASCIIHost() (string, error) {
+	host, err := idna.Lookup.ToASCII(u.Hostname())
+	if err != nil {
+		return "", newError("failed to convert host to punycode: ", u.Hostname()).Base(err)
+	}
+	return host, nil
+}
+
+func (u *netURL) GetUnicodeHost() string {
+	host, _ := idna.Display.ToUnicode(u.Hostname())
+	return host
+}
+
 func (u *netURL) SetHost(host string) {
 	_, port, err := net.SplitHostPort(u.Host)
 	if err == nil {
@@ -178,10 +301,22 @@ func (u *netURL) QueryParameterNotBlank(key string) string {
 	return u.Get(key)
 }
 
+func (u *netURL) GetQueryParameterKeys() string {
+	return strings.Join(u.Keys(), "\n")
+}
+
+func (u *netURL) GetQueryParameterValues(key string) string {
+	return strings.Join(u.Values(key), "\n")
+}
+
 func (u *netURL) AddQueryParameter(key, value string) {
 	u.Add(key, value)
 }
 
+func (u *netURL) SetQueryParameter(key, value string) {
+	u.Set(key, value)
+}
+
 func (u *netURL) DeleteQueryParameter(key string) {
 	u.Del(key)
 }
@@ -1,16 +1,24 @@
 package libcore
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 	_ "unsafe"
 
 	"github.com/v2fly/v2ray-core/v5"
+	"github.com/v2fly/v2ray-core/v5/common/buf"
 	"github.com/v2fly/v2ray-core/v5/common/net"
 	"github.com/v2fly/v2ray-core/v5/common/net/cnc"
+	udpProtocol "github.com/v2fly/v2ray-core/v5/common/protocol/udp"
+	"github.com/v2fly/v2ray-core/v5/common/session"
+	"github.com/v2fly/v2ray-core/v5/common/signal/done"
 	"github.com/v2fly/v2ray-core/v5/features"
 	"github.com/v2fly/v2ray-core/v5/features/dns"
 	"github.com/v2fly/v2ray-core/v5/features/extension"
@@ -20,6 +28,7 @@ import (
 	"github.com/v2fly/v2ray-core/v5/infra/conf/serial"
 	_ "github.com/v2fly/v2ray-core/v5/main/distro/all"
 	"github.com/v2fly/v2ray-core/v5/transport/internet/udp"
+	"libcore/comm"
 )
 
 func GetV2RayVersion() string {
@@ -35,6 +44,9 @@ type V2RayInstance struct {
 	statsManager    stats.Manager
 	observatory     features.TaggedFeatures
 	dnsClient       dns.Client
+
+	// loadConfig loads the last config again for Reload.
+	loadConfig func() (*core.Config, error)
 }
 
 func NewV2rayInstance() *V2RayInstance {
@@ -42,7 +54,71 @@ func NewV2rayInstance() *V2RayInstance {
 }
 
 func (instance *V2RayInstance) LoadConfig(content string) error {
-	config, err := serial.LoadJSONConfig(strings.NewReader(content))
+	return instance.LoadConfigWithFormat([]byte(content), ConfigFormatJSON)
+}
+
+// LoadConfigWithFormat loads a config in one of the ConfigFormat constants, or detects the format if it is auto.
+func (instance *V2RayInstance) LoadConfigWithFormat(content []byte, format string) error {
+	return instance.load(func() (*core.Config, error) {
+		return loadCoreConfig(content, format)
+	})
+}
+
+// LoadConfigFragments merges the fragments in order and loads the result.
+func (instance *V2RayInstance) LoadConfigFragments(fragments *ConfigFragments) error {
+	content, err := fragments.merge()
+	if err != nil {
+		return err
+	}
+	return instance.load(func() (*core.Config, error) {
+		return serial.LoadJSONConfig(bytes.NewReader(content))
+	})
+}
+
+func (instance *V2RayInstance) load(loadConfig func() (*core.Config, error)) error {
+	config, err := loadConfigExtractingAssets(loadConfig)
+	if err != nil {
+		return err
+	}
+	c, err := core.New(config)
+	if err != nil {
+		return err
+	}
+	instance.setCore(c)
+	instance.loadConfig = loadConfig
+	return nil
+}
+
+// Reload loads the last config again, for example after the geo files are updated.
+// The current core keeps running if the config fails to load, otherwise it is replaced and the new one is started if the instance was started.
+func (instance *V2RayInstance) Reload() error {
+	if instance.loadConfig == nil {
+		return errors.New("not initialized")
+	}
+	config, err := instance.loadConfig()
+	if err != nil {
+		return err
+	}
+	c, err := core.New(config)
+	if err != nil {
+		return err
+	}
+	started := instance.started
+	if err = instance.core.Close(); err != nil && started {
+		comm.CloseIgnore(c)
+		return newError("failed to close the running core").Base(err)
+	}
+	instance.started = false
+	instance.setCore(c)
+	if started {
+		return instance.Start()
+	}
+	return nil
+}
+
+// loadConfigExtractingAssets retries loading once after extracting the geo files if they are missing or outdated.
+func loadConfigExtractingAssets(load func() (*core.Config, error)) (*core.Config, error) {
+	config, err := load()
 	if err != nil {
 		if strings.HasSuffix(err.Error(), "geoip.dat: no such file or directory") {
 			err = extractAssetName(geoipDat, true)
@@ -54,17 +130,13 @@ func (instance *V2RayInstance) LoadConfig(content string) error {
 			err = extractAssetName(geositeDat, false)
 		}
 		if err == nil {
-			config, err = serial.LoadJSONConfig(strings.NewReader(content))
+			config, err = load()
 		}
 	}
-	if err != nil {
-		return err
-	}
+	return config, err
+}
 
-	c, err := core.New(config)
-	if err != nil {
-		return err
-	}
+func (instance *V2RayInstance) setCore(c *core.Instance) {
 	instance.core = c
 	instance.statsManager = c.GetFeature(stats.ManagerType()).(stats.Manager)
 	instance.router = c.GetFeature(routing.RouterType()).(routing.Router)
@@ -72,11 +144,11 @@ func (instance *V2RayInstance) LoadConfig(content string) error {
 	instance.dispatcher = c.GetFeature(routing.DispatcherType()).(routing.Dispatcher)
 	instance.dnsClient = c.GetFeature(dns.ClientType()).(dns.Client)
 
+	instance.observatory = nil
 	o := c.GetFeature(extension.ObservatoryType())
 	if o != nil {
 		instance.observatory = o.(features.TaggedFeatures)
 	}
-	return nil
 }
 
 func (instance *V2RayInstance) Start() error {
@@ -141,3 +213,142 @@ func (instance *V2RayInstance) dialUDP(ctx context.Context) (net.PacketConn, err
 	ctx = toContext(ctx, instance.core)
 	return udp.DialDispatcher(ctx, instance.dispatcher)
 }
+
+func contextWithOutbound(ctx context.Context, outboundTag string) context.Context {
+	if outboundTag == "" {
+		return ctx
+	}
+	return session.SetForcedOutboundTagToContext(ctx, outboundTag)
+}
+
+// dialPacketConn returns a packet conn through the outbound with deadline support.
+func (instance *V2RayInstance) dialPacketConn(ctx context.Context, outboundTag string) (net.PacketConn, error) {
+	if !instance.started {
+		return nil, os.ErrInvalid
+	}
+	conn, err := instance.dialUDP(contextWithOutbound(ctx, outboundTag))
+	if err != nil {
+		return nil, err
+	}
+	return comm.DeadlinePacketConn(conn), nil
+}
+
+// domainPlaceholderIP stands for the domain of a domainPacketConn in addresses.
+var domainPlaceholderIP = net.IP{198, 18, 0, 1}
+
+// dialDomainPacketConn is dialPacketConn sending packets for domainPlaceholderIP to the domain,
+// so that it is resolved by the outbound instead of the dns client of the instance.
+func (instance *V2RayInstance) dialDomainPacketConn(ctx context.Context, outboundTag string, domain string) (net.PacketConn, error) {
+	if !instance.started {
+		return nil, os.ErrInvalid
+	}
+	conn := &domainPacketConn{
+		ctx:     toContext(contextWithOutbound(ctx, outboundTag), instance.core),
+		domain:  domain,
+		packets: make(chan *udpProtocol.Packet, 16),
+		done:    done.New(),
+	}
+	conn.dispatcher = udp.NewSplitDispatcher(instance.dispatcher, conn.callback)
+	return comm.DeadlinePacketConn(conn), nil
+}
+
+// domainPacketConn is the packet conn of udp.DialDispatcher with domain destinations,
+// packets from the domain are reported from domainPlaceholderIP.
+type domainPacketConn struct {
+	ctx        context.Context
+	domain     string
+	dispatcher udp.DispatcherI
+	packets    chan *udpProtocol.Packet
+	done       *done.Instance
+}
+
+func (c *domainPacketConn) callback(_ context.Context, packet *udpProtocol.Packet) {
+	select {
+	case <-c.done.Wait():
+		packet.Payload.Release()
+	case c.packets <- packet:
+	default:
+		packet.Payload.Release()
+	}
+}
+
+func (c *domainPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case <-c.done.Wait():
+		return 0, nil, io.EOF
+	case packet := <-c.packets:
+		n := copy(p, packet.Payload.Bytes())
+		packet.Payload.Release()
+		addr := &net.UDPAddr{IP: domainPlaceholderIP, Port: int(packet.Source.Port)}
+		if packet.Source.Address.Family().IsIP() {
+			addr.IP = packet.Source.Address.IP()
+		}
+		return n, addr, nil
+	}
+}
+
+func (c *domainPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, newError("unsupported address ", addr)
+	}
+	destination := net.UDPDestination(net.IPAddress(udpAddr.IP), net.Port(udpAddr.Port))
+	if udpAddr.IP.Equal(domainPlaceholderIP) {
+		destination.Address = net.DomainAddress(c.domain)
+	}
+	buffer := buf.New()
+	n := copy(buffer.Extend(buf.Size), p)
+	buffer.Resize(0, int32(n))
+	c.dispatcher.Dispatch(c.ctx, destination, buffer)
+	return n, nil
+}
+
+func (c *domainPacketConn) Close() error {
+	return c.done.Close()
+}
+
+func (c *domainPacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IP{0, 0, 0, 0}}
+}
+
+func (c *domainPacketConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *domainPacketConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *domainPacketConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (instance *V2RayInstance) lookupIP(host string) (net.IP, error) {
+	ips, err := instance.dnsClient.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, newError("no ip address found for ", host)
+	}
+	return ips[0], nil
+}
+
+func (instance *V2RayInstance) resolveUDPAddr(address string) (*net.UDPAddr, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, newError("invalid port ", portStr).Base(err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ip, err = instance.lookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}